@@ -0,0 +1,226 @@
+package dl
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Kinds of ABI changes
+const (
+	ChangeRemoved = "removed" // symbol was removed
+	ChangeAdded   = "added"   // symbol was added
+	ChangeType    = "type"    // type of symbol was changed (like func to object)
+	ChangeVersion = "version" // version of symbol was removed or added
+	ChangeProto   = "proto"   // prototype of function was changed
+	ChangeLayout  = "layout"  // layout of struct used by function was changed
+)
+
+// Change describes difference of symbol between two versions of library
+type Change struct {
+	Symbol   string `json:"symbol"`
+	Kind     string `json:"kind"`
+	Old      string `json:"old,omitempty"`
+	New      string `json:"new,omitempty"`
+	Breaking bool   `json:"breaking,omitempty"` // Symbol is used by bindings
+}
+
+func (c Change) String() string {
+	switch {
+	case c.Old != "" && c.New != "":
+		return fmt.Sprintf("%s: %s: %s => %s", c.Symbol, c.Kind, c.Old, c.New)
+	case c.Old != "":
+		return fmt.Sprintf("%s: %s: %s", c.Symbol, c.Kind, c.Old)
+	case c.New != "":
+		return fmt.Sprintf("%s: %s: %s", c.Symbol, c.Kind, c.New)
+	default:
+		return fmt.Sprintf("%s: %s", c.Symbol, c.Kind)
+	}
+}
+
+// ABIDiff is a result of comparison of two versions of library
+type ABIDiff struct {
+	Changes []Change `json:"changes"`
+	// Prototypes and struct layouts were compared (both versions have debug info)
+	Prototypes bool `json:"prototypes"`
+}
+
+// Breaking returns changes of symbols used by bindings
+func (d *ABIDiff) Breaking() []Change {
+	var res []Change
+	for _, c := range d.Changes {
+		if c.Breaking {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// DiffABI compares exported symbols, symbol versions and (when both
+// versions have debug info) function prototypes and struct layouts of two
+// versions of library. Removed and changed symbols used by routines
+// are flagged as breaking.
+func DiffABI(oldPath, newPath string, routines ...*Routine) (*ABIDiff, error) {
+	oldSyms, err := exportsByName(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("abi diff: %w", err)
+	}
+	newSyms, err := exportsByName(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("abi diff: %w", err)
+	}
+
+	used := make(map[string]bool, len(routines))
+	for ii, routine := range routines {
+		if routine == nil {
+			return nil, fmt.Errorf("abi diff: routine %d is nil", ii)
+		}
+		used[routine.Name] = true
+	}
+
+	diff := &ABIDiff{}
+	add := func(c Change) {
+		if c.Kind != ChangeAdded && used[c.Symbol] {
+			c.Breaking = true
+		}
+		diff.Changes = append(diff.Changes, c)
+	}
+
+	for name, old := range oldSyms {
+		cur, ok := newSyms[name]
+		if !ok {
+			add(Change{Symbol: name, Kind: ChangeRemoved, Old: old[0].Type})
+			continue
+		}
+		if old[0].Type != cur[0].Type {
+			add(Change{Symbol: name, Kind: ChangeType, Old: old[0].Type, New: cur[0].Type})
+		}
+		for _, v := range versions(old) {
+			if !hasVersion(cur, v) {
+				add(Change{Symbol: name, Kind: ChangeVersion, Old: v})
+			}
+		}
+		for _, v := range versions(cur) {
+			if !hasVersion(old, v) {
+				diff.Changes = append(diff.Changes, Change{Symbol: name, Kind: ChangeVersion, New: v})
+			}
+		}
+	}
+	for name, cur := range newSyms {
+		if _, ok := oldSyms[name]; !ok {
+			add(Change{Symbol: name, Kind: ChangeAdded, New: cur[0].Type})
+		}
+	}
+
+	oldInfo, oldErr := loadDebugInfo(oldPath)
+	newInfo, newErr := loadDebugInfo(newPath)
+	if oldErr == nil && newErr == nil {
+		diff.Prototypes = true
+		for name, old := range oldSyms {
+			if _, ok := newSyms[name]; !ok || old[0].Type != "func" {
+				continue
+			}
+			oldFn, newFn := oldInfo.funcs[name], newInfo.funcs[name]
+			if oldFn == nil || newFn == nil {
+				continue
+			}
+			for _, c := range diffFunc(oldFn, newFn) {
+				add(c)
+			}
+		}
+	}
+
+	sort.Slice(diff.Changes, func(i, j int) bool {
+		a, b := diff.Changes[i], diff.Changes[j]
+		if a.Breaking != b.Breaking {
+			return a.Breaking
+		}
+		if a.Symbol != b.Symbol {
+			return a.Symbol < b.Symbol
+		}
+		return a.Kind < b.Kind
+	})
+
+	return diff, nil
+}
+
+// exportsByName groups exported symbols by name
+func exportsByName(path string) (map[string][]Export, error) {
+	exports, err := Exports(path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]Export, len(exports))
+	for _, e := range exports {
+		res[e.Name] = append(res[e.Name], e)
+	}
+	return res, nil
+}
+
+func versions(exports []Export) []string {
+	var res []string
+	for _, e := range exports {
+		if e.Version != "" {
+			res = append(res, e.Version)
+		}
+	}
+	return res
+}
+
+func hasVersion(exports []Export, version string) bool {
+	for _, e := range exports {
+		if e.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// diffFunc compares prototypes and layouts of structs passed by pointer
+func diffFunc(old, cur *cfunc) []Change {
+	if old.String() != cur.String() {
+		return []Change{{Symbol: old.name, Kind: ChangeProto, Old: old.String(), New: cur.String()}}
+	}
+
+	var res []Change
+	oldTypes := append([]*ctype{old.result}, old.params...)
+	newTypes := append([]*ctype{cur.result}, cur.params...)
+	for ii := range oldTypes {
+		o, n := oldTypes[ii], newTypes[ii]
+		if o == nil || n == nil || o.kind != ctypePointer || n.kind != ctypePointer {
+			continue
+		}
+		if o.elem.kind != ctypeStruct && o.elem.kind != ctypeUnion {
+			continue
+		}
+		if ol, nl := o.elem.layout(), n.elem.layout(); ol != nl {
+			res = append(res, Change{Symbol: old.name, Kind: ChangeLayout, Old: ol, New: nl})
+		}
+	}
+
+	return res
+}
+
+// layout returns description of struct layout, like "struct point {int x@0; int y@4} size 8"
+func (t *ctype) layout() string {
+	return t.describe(make(map[*ctype]bool))
+}
+
+func (t *ctype) describe(seen map[*ctype]bool) string {
+	if t.kind != ctypeStruct && t.kind != ctypeUnion || seen[t] {
+		return t.String()
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	members := make([]string, len(t.members))
+	for ii, m := range t.members {
+		s := fmt.Sprintf("%s %s@%d", m.typ.describe(seen), m.name, m.offset)
+		if m.bitSize != 0 {
+			s = fmt.Sprintf("%s %s@%d:%d", m.typ.describe(seen), m.name, m.bitOffset, m.bitSize)
+		}
+		members[ii] = s
+	}
+	return fmt.Sprintf("%s {%s} size %d", t, strings.Join(members, "; "), t.size)
+}
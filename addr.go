@@ -0,0 +1,55 @@
+package dl
+
+import (
+	"fmt"
+	"path/filepath"
+	"unsafe"
+)
+
+// Location describes address resolved by Addr
+type Location struct {
+	Library    string  `json:"library"`               // Path of the containing object
+	Base       uintptr `json:"base"`                  // Load base address of the object
+	Symbol     string  `json:"symbol,omitempty"`      // Nearest symbol, empty if unknown
+	SymbolAddr uintptr `json:"symbol_addr,omitempty"` // Address of the symbol
+	Size       uint64  `json:"size,omitempty"`        // Size of the symbol
+	Offset     uintptr `json:"offset"`                // Offset from the symbol (or base, if symbol is unknown)
+}
+
+// String returns symbolic name of the address, like libc.so.6!abs+0x10
+func (l *Location) String() string {
+	name := filepath.Base(l.Library)
+	if l.Symbol != "" {
+		name += "!" + l.Symbol
+	}
+	if l.Offset != 0 {
+		name += fmt.Sprintf("+%#x", l.Offset)
+	}
+	return name
+}
+
+// addressOf converts uintptr, unsafe.Pointer or C memory into address
+func addressOf(ptr interface{}) (uintptr, error) {
+	switch p := ptr.(type) {
+	case uintptr:
+		return p, nil
+	case unsafe.Pointer:
+		return uintptr(p), nil
+	case pointer:
+		return uintptr(p.Pointer()), nil
+	default:
+		return 0, fmt.Errorf("unsupported pointer type %T", ptr)
+	}
+}
+
+// symbolize returns symbolic name of the address or empty string
+func symbolize(addr uintptr) string {
+	if addr == 0 {
+		return ""
+	}
+	loc, err := Addr(addr)
+	if err != nil {
+		return ""
+	}
+	return loc.String()
+}
@@ -0,0 +1,146 @@
+// +build linux
+
+package dl
+
+/*
+#cgo LDFLAGS: -ldl
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <link.h>
+#include <stdint.h>
+#include <string.h>
+
+typedef struct {
+    const char *fname;
+    uintptr_t fbase;
+    const char *sname;
+    uintptr_t saddr;
+    unsigned long size;
+} addr_info;
+
+static int addr_lookup(uintptr_t addr, addr_info *out)
+{
+    Dl_info info;
+    ElfW(Sym) *sym = NULL;
+    if (dladdr1((void *)addr, &info, (void **)&sym, RTLD_DL_SYMENT) == 0) {
+        return 0;
+    }
+    out->fname = info.dli_fname;
+    out->fbase = (uintptr_t)info.dli_fbase;
+    out->sname = info.dli_sname;
+    out->saddr = (uintptr_t)info.dli_saddr;
+    out->size = sym != NULL ? sym->st_size : 0;
+    return 1;
+}
+
+static void addr_read(uintptr_t addr, void *dst, size_t size)
+{
+    memcpy(dst, (const void *)addr, size);
+}
+*/
+import "C"
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// Addr finds the loaded object and the nearest symbol containing the address.
+// Pointer might be uintptr, unsafe.Pointer or C memory (like *Memory).
+func Addr(ptr interface{}) (*Location, error) {
+	addr, err := addressOf(ptr)
+	if err != nil {
+		return nil, fmt.Errorf("addr: %w", err)
+	}
+
+	var info C.addr_info
+	if C.addr_lookup(C.uintptr_t(addr), &info) == 0 {
+		return nil, fmt.Errorf("addr: %#x is not in any loaded object", addr)
+	}
+
+	loc := &Location{
+		Library: C.GoString(info.fname),
+		Base:    uintptr(info.fbase),
+		Offset:  addr - uintptr(info.fbase),
+	}
+	if info.sname != nil {
+		loc.Symbol = C.GoString(info.sname)
+		loc.SymbolAddr = uintptr(info.saddr)
+		loc.Size = uint64(info.size)
+		loc.Offset = addr - loc.SymbolAddr
+	}
+
+	return loc, nil
+}
+
+// ReadMemory copies size bytes of C memory at the address (like memory
+// returned by C or found by Addr). The whole range must lie in readable
+// mappings of the process, otherwise nothing is read.
+func ReadMemory(addr, size uintptr) ([]byte, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	if err := checkMapping(addr, size, 'r'); err != nil {
+		return nil, fmt.Errorf("read memory: %w", err)
+	}
+
+	buf := make([]byte, size)
+	C.addr_read(C.uintptr_t(addr), unsafe.Pointer(&buf[0]), C.size_t(size))
+	return buf, nil
+}
+
+// checkMapping validates, that range [addr, addr+size) lies in mappings
+// of the process with permission perm ('r', 'w' or 'x')
+func checkMapping(addr, size uintptr, perm byte) error {
+	end := uint64(addr) + uint64(size)
+	if end < uint64(addr) {
+		return fmt.Errorf("%#x+%d overflows address space", addr, size)
+	}
+	index := strings.IndexByte("rwx", perm)
+
+	f, err := os.Open("/proc/self/maps")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Lines look like: 7f0e1c000000-7f0e1c021000 r-xp 00000000 08:01 1234 /lib/libc.so.6
+	// and are sorted by address, so the range is checked mapping by mapping.
+	cur := uint64(addr)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		bounds := strings.SplitN(fields[0], "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		lo, err1 := strconv.ParseUint(bounds[0], 16, 64)
+		hi, err2 := strconv.ParseUint(bounds[1], 16, 64)
+		if err1 != nil || err2 != nil || hi <= cur {
+			continue
+		}
+		if lo > cur {
+			break
+		}
+		if len(fields[1]) <= index || fields[1][index] != perm {
+			return fmt.Errorf("%#x is not %s", cur, permNames[perm])
+		}
+		if cur = hi; cur >= end {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return fmt.Errorf("%#x is not mapped", cur)
+}
+
+var permNames = map[byte]string{'r': "readable", 'w': "writable", 'x': "executable"}
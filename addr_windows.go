@@ -0,0 +1,17 @@
+// +build windows
+
+package dl
+
+import "errors"
+
+// Addr finds the loaded object and the nearest symbol containing the address
+func Addr(ptr interface{}) (*Location, error) {
+	// Not yet implemented
+	return nil, errors.New("addr: not supported")
+}
+
+// ReadMemory copies size bytes of C memory at the address
+func ReadMemory(addr, size uintptr) ([]byte, error) {
+	// Not yet implemented
+	return nil, errors.New("read memory: not supported")
+}
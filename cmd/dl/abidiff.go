@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/adverax/dl"
+)
+
+func runABIDiff(args []string) error {
+	fs, asJSON := newFlags("abidiff")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 && fs.NArg() != 3 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	oldPath, err := dl.Find(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	newPath, err := dl.Find(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	var routines []*dl.Routine
+	if fs.NArg() == 3 {
+		defs, err := readBindings(fs.Arg(2))
+		if err != nil {
+			return err
+		}
+		for _, def := range defs {
+			routine, err := dl.ParseRoutineDefinition(def.text)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", fs.Arg(2), def.line, err)
+			}
+			routines = append(routines, routine)
+		}
+	}
+
+	diff, err := dl.DiffABI(oldPath, newPath, routines...)
+	if err != nil {
+		return err
+	}
+
+	err = output(*asJSON, diff, func(w io.Writer) {
+		if !diff.Prototypes {
+			fmt.Fprintln(w, "# no debug info, prototypes are not compared")
+		}
+		for _, c := range diff.Changes {
+			status := "\t"
+			if c.Breaking {
+				status = "BREAKING\t"
+			}
+			fmt.Fprintf(w, "%s%s\n", status, c)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(diff.Breaking()) != 0 {
+		return errFailed{}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"github.com/adverax/dl"
+)
+
+type callResult struct {
+	Routine string        `json:"routine"`
+	Args    []interface{} `json:"args"`
+	Result  interface{}   `json:"result,omitempty"`
+}
+
+func runCall(args []string) error {
+	fs, asJSON := newFlags("call")
+	_ = fs.Parse(args)
+	rest := fs.Args()
+	if len(rest) < 2 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	name, def := rest[0], rest[1]
+	values := rest[2:]
+	if len(values) > 0 && values[0] == "--" {
+		values = values[1:]
+	}
+
+	routine, err := dl.ParseRoutineDefinition(def)
+	if err != nil {
+		return err
+	}
+	if len(values) != len(routine.Args) {
+		return fmt.Errorf("%s expects %d arguments, got %d", routine.Name, len(routine.Args), len(values))
+	}
+	for ii, arg := range routine.Args {
+		if arg.Pointer {
+			return fmt.Errorf("argument %d: pointer arguments are not supported", ii)
+		}
+	}
+
+	lib, err := dl.Open(name, 0)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	if err := lib.Define(routine); err != nil {
+		return err
+	}
+
+	arguments := make([]interface{}, len(values))
+	for ii, v := range values {
+		arguments[ii], err = parseLiteral(routine.Args[ii], v)
+		if err != nil {
+			return fmt.Errorf("argument %d: %w", ii, err)
+		}
+	}
+
+	res, err := lib.Call(routine.Name, arguments...)
+	if err != nil {
+		return err
+	}
+
+	if p := reflect.ValueOf(res); p.Kind() == reflect.Ptr && p.Type().Elem().Kind() == reflect.String {
+		if p.IsNil() {
+			return errors.New("routine returned NULL")
+		}
+		res = p.Elem().Interface()
+	}
+
+	result := callResult{
+		Routine: routine.Name,
+		Args:    arguments,
+		Result:  res,
+	}
+
+	return output(*asJSON, result, func(w io.Writer) {
+		if routine.Result == nil {
+			return
+		}
+		fmt.Fprintln(w, res)
+	})
+}
+
+// parseLiteral converts literal into value of the argument type.
+// Integers might be written in any base known to Go (0x10, 0o20, 0b10000).
+func parseLiteral(arg *dl.Arg, token string) (interface{}, error) {
+	if arg.Pointer {
+		return token, nil
+	}
+
+	v := reflect.New(reflect.TypeOf(dl.MakeValue(arg.Type, false))).Elem()
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := strconv.ParseBool(token)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bool %q", token)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(token, 0, v.Type().Bits())
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", v.Type(), token)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(token, 0, v.Type().Bits())
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", v.Type(), token)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(token, v.Type().Bits())
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", v.Type(), token)
+		}
+		v.SetFloat(f)
+	default:
+		return token, nil
+	}
+
+	return v.Interface(), nil
+}
@@ -0,0 +1,88 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/adverax/dl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseLiteral(t *testing.T) {
+	tests := []struct {
+		arg   *dl.Arg
+		token string
+		value interface{}
+		err   bool
+	}{
+		{arg: &dl.Arg{Type: reflect.Int}, token: "-5", value: -5},
+		{arg: &dl.Arg{Type: reflect.Int}, token: "0x10", value: 16},
+		{arg: &dl.Arg{Type: reflect.Int}, token: "0b101", value: 5},
+		{arg: &dl.Arg{Type: reflect.Int8}, token: "127", value: int8(127)},
+		{arg: &dl.Arg{Type: reflect.Int8}, token: "128", err: true},
+		{arg: &dl.Arg{Type: reflect.Uint16}, token: "0xffff", value: uint16(0xffff)},
+		{arg: &dl.Arg{Type: reflect.Uint32}, token: "-1", err: true},
+		{arg: &dl.Arg{Type: reflect.Float32}, token: "1.5", value: float32(1.5)},
+		{arg: &dl.Arg{Type: reflect.Float64}, token: "-2e3", value: -2e3},
+		{arg: &dl.Arg{Type: reflect.Bool}, token: "true", value: true},
+		{arg: &dl.Arg{Type: reflect.Int}, token: "five", err: true},
+		{arg: &dl.Arg{Type: reflect.String}, token: "0x10", value: "0x10"},
+		{arg: &dl.Arg{Type: reflect.Int, Pointer: true}, token: "5", value: "5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg.Type.String()+" "+tt.token, func(t *testing.T) {
+			v, err := parseLiteral(tt.arg, tt.token)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.value, v)
+		})
+	}
+}
+
+func TestRunCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		result interface{}
+		err    bool
+	}{
+		{name: "int", args: []string{"libc", "int abs(int)", "--", "-5"}, result: float64(5)},
+		{name: "hex", args: []string{"libc", "int abs(int)", "--", "-0x10"}, result: float64(16)},
+		{name: "int64", args: []string{"libc", "int64 labs(int64)", "--", "-1234567890123"}, result: float64(1234567890123)},
+		{name: "string", args: []string{"libc", "uint strlen(string)", "--", "hello"}, result: float64(5)},
+		{name: "float", args: []string{"libm.so.6", "float64 fabs(float64)", "--", "-1.5"}, result: 1.5},
+		{name: "void", args: []string{"libc", "void srand(uint32)", "1"}},
+		{name: "count", args: []string{"libc", "int abs(int)", "--"}, err: true},
+		{name: "literal", args: []string{"libc", "int abs(int)", "--", "five"}, err: true},
+		{name: "pointer", args: []string{"libc", "int abs(int *)", "--", "0"}, err: true},
+		{name: "symbol", args: []string{"libc", "int no_such_routine(int)", "--", "1"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			stdout = &buf
+			defer func() { stdout = os.Stdout }()
+
+			err := runCall(append([]string{"-json"}, tt.args...))
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			var res callResult
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &res))
+			assert.Equal(t, tt.result, res.Result)
+		})
+	}
+}
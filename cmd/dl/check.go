@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/adverax/dl"
+)
+
+type checkResult struct {
+	Line       int    `json:"line"`
+	Definition string `json:"definition"`
+	Routine    string `json:"routine,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func runCheck(args []string) error {
+	fs, asJSON := newFlags("check")
+	_ = fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	defs, err := readBindings(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	lib, err := dl.Open(fs.Arg(0), 0)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+
+	failed := false
+	results := make([]checkResult, 0, len(defs))
+	for _, def := range defs {
+		res := checkResult{Line: def.line, Definition: def.text}
+		routine, err := dl.ParseRoutineDefinition(def.text)
+		if err == nil {
+			res.Routine = routine.Name
+			err = lib.Define(routine)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			failed = true
+		}
+		results = append(results, res)
+	}
+
+	err = output(*asJSON, results, func(w io.Writer) {
+		for _, res := range results {
+			if res.Error != "" {
+				fmt.Fprintf(w, "FAIL\t%d: %s: %s\n", res.Line, res.Definition, res.Error)
+				continue
+			}
+			fmt.Fprintf(w, "ok\t%s\n", res.Routine)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		return errFailed{}
+	}
+
+	return nil
+}
+
+type binding struct {
+	line int
+	text string
+}
+
+// readBindings reads routine definitions from file
+func readBindings(path string) ([]binding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []binding
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		res = append(res, binding{line: line, text: strings.TrimSuffix(text, ";")})
+	}
+
+	return res, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/adverax/dl"
+)
+
+type dependencies struct {
+	Object *dl.Object      `json:"object"`
+	Deps   []dl.Dependency `json:"dependencies"`
+}
+
+func runDeps(args []string) error {
+	fs, asJSON := newFlags("deps")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	path, err := dl.Find(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	obj, deps, err := dl.Resolve(path)
+	if err != nil {
+		return err
+	}
+
+	failed := false
+	for _, dep := range deps {
+		failed = failed || dep.Error != ""
+	}
+
+	err = output(*asJSON, dependencies{Object: obj, Deps: deps}, func(w io.Writer) {
+		fmt.Fprintf(w, "%s: %s %s\n", obj.Path, obj.Class, obj.Machine)
+		for _, dep := range deps {
+			if dep.Error != "" {
+				fmt.Fprintf(w, "\t%s => %s (needed by %s)\n", dep.Name, dep.Error, dep.Parent)
+				continue
+			}
+			fmt.Fprintf(w, "\t%s => %s\n", dep.Name, dep.Object.Path)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		return errFailed{}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/adverax/dl"
+)
+
+type genResult struct {
+	Routine    string `json:"routine,omitempty"`
+	Definition string `json:"definition,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func runGen(args []string) error {
+	fs, asJSON := newFlags("gen")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	path, err := dl.Find(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	routines, err := dl.GenerateRoutines(path, fs.Args()[1:]...)
+	if err != nil && routines == nil {
+		return err
+	}
+
+	var results []genResult
+	for _, routine := range routines {
+		def, err := dl.FormatRoutine(routine)
+		if err != nil {
+			results = append(results, genResult{Routine: routine.Name, Error: err.Error()})
+			continue
+		}
+		results = append(results, genResult{Routine: routine.Name, Definition: def})
+	}
+	for _, e := range skipped(err) {
+		results = append(results, genResult{Error: e.Error()})
+	}
+
+	return output(*asJSON, results, func(w io.Writer) {
+		for _, res := range results {
+			if res.Error != "" {
+				// Bindings file stays valid
+				fmt.Fprintf(w, "# %s\n", res.Error)
+				continue
+			}
+			fmt.Fprintln(w, res.Definition)
+		}
+	})
+}
+
+// skipped returns errors of routines, which were not generated
+func skipped(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := errors.Unwrap(err).(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
@@ -0,0 +1,119 @@
+// Command dl inspects shared libraries and calls their routines.
+//
+// Usage:
+//
+//	dl symbols [-json] library
+//	dl deps [-json] library
+//	dl call [-json] library "prototype" -- [arguments...]
+//	dl check [-json] library bindings
+//	dl gen [-json] library [routines...]
+//	dl abidiff [-json] old new [bindings]
+//	dl repl library
+//
+// Library is a path or a name of shared library, like "libc".
+// Command abidiff exits with status 1, when symbols used by bindings are changed.
+// Bindings is a file with routine definitions (one per line),
+// empty lines and lines started with # are ignored.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []*command
+
+// stdout receives output of commands
+var stdout io.Writer = os.Stdout
+
+func init() {
+	commands = []*command{
+		{name: "symbols", usage: "[-json] library", run: runSymbols},
+		{name: "deps", usage: "[-json] library", run: runDeps},
+		{name: "call", usage: "[-json] library \"prototype\" -- [arguments...]", run: runCall},
+		{name: "check", usage: "[-json] library bindings", run: runCheck},
+		{name: "gen", usage: "[-json] library [routines...]", run: runGen},
+		{name: "abidiff", usage: "[-json] old new [bindings]", run: runABIDiff},
+		{name: "repl", usage: "library", run: runRepl},
+	}
+}
+
+// errFailed reports failure, which was already printed
+type errFailed struct{}
+
+func (errFailed) Error() string { return "failed" }
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		err := cmd.run(flag.Args()[1:])
+		switch err.(type) {
+		case nil:
+			return
+		case errFailed:
+			os.Exit(1)
+		default:
+			fmt.Fprintf(os.Stderr, "dl %s: %v\n", name, err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "dl: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\tdl %s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// newFlags creates flag set of the command with common -json flag
+func newFlags(name string) (*flag.FlagSet, *bool) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print output as JSON")
+	for _, cmd := range commands {
+		if cmd.name == name {
+			usage := cmd.usage
+			fs.Usage = func() {
+				fmt.Fprintf(os.Stderr, "Usage: dl %s %s\n", name, usage)
+				fs.PrintDefaults()
+			}
+		}
+	}
+	return fs, asJSON
+}
+
+// output prints value as JSON or as text
+func output(asJSON bool, v interface{}, text func(w io.Writer)) error {
+	if asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	text(stdout)
+	return nil
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/adverax/dl"
+	"github.com/peterh/liner"
+)
+
+const replHelp = `Commands:
+  def <prototype>           define routine, like: def int abs(int)
+  defs                      list defined routines
+  <routine>(<args>)         call routine, like: abs(-5)
+  alloc <name> <size>       allocate C buffer, which is passed as $name
+  free <name>               release C buffer
+  sym <name> <type>         read global (int8..uint64, int, uint, float32, float64, string, pointer)
+  dump <$var|address> [n]   hex dump of n bytes (64 by default)
+  addr <$var|address>       library and symbol containing the address
+  symbols [prefix]          list exported symbols
+  vars                      list buffers and results
+  help                      show this help
+  quit                      leave the shell
+Arguments are literals (-5, 0x10, 1.5, "text", null) or variables ($name, $1, $_).
+`
+
+var callRe = regexp.MustCompile(`^(\w+)\s*\((.*)\)\s*;?$`)
+
+// address is a raw C pointer passed to routines as an integer
+type address uintptr
+
+// session is a state of interactive shell
+type session struct {
+	out      io.Writer
+	lib      dl.Library
+	exports  []string
+	routines map[string]*dl.Routine
+	buffers  map[string]*dl.Memory
+	values   map[string]interface{}
+	results  int
+}
+
+func runRepl(args []string) error {
+	fs, _ := newFlags("repl")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	s, err := newSession(fs.Arg(0), os.Stdout)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+	line.SetWordCompleter(s.complete)
+
+	history := historyPath()
+	if f, err := os.Open(history); err == nil {
+		_, _ = line.ReadHistory(f)
+		f.Close()
+	}
+	defer func() {
+		if f, err := os.Create(history); err == nil {
+			_, _ = line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	fmt.Fprintf(s.out, "Library %s. Type help for the list of commands.\n", fs.Arg(0))
+	for {
+		text, err := line.Prompt("dl> ")
+		if err == liner.ErrPromptAborted || err == io.EOF {
+			fmt.Fprintln(s.out)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		line.AppendHistory(text)
+
+		if text == "quit" || text == "exit" {
+			return nil
+		}
+		if err := s.exec(text); err != nil {
+			fmt.Fprintf(s.out, "error: %v\n", err)
+		}
+	}
+}
+
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".dl_history"
+	}
+	return filepath.Join(home, ".dl_history")
+}
+
+func newSession(name string, out io.Writer) (*session, error) {
+	lib, err := dl.Open(name, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		out:      out,
+		lib:      lib,
+		routines: make(map[string]*dl.Routine),
+		buffers:  make(map[string]*dl.Memory),
+		values:   make(map[string]interface{}),
+	}
+
+	// Exported names are used for completion only
+	if path, err := dl.Find(name); err == nil {
+		if exports, err := dl.Exports(path); err == nil {
+			for _, e := range exports {
+				s.exports = append(s.exports, e.Name)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *session) close() {
+	for _, m := range s.buffers {
+		m.Free()
+	}
+	_ = s.lib.Close()
+}
+
+func (s *session) exec(text string) error {
+	if m := callRe.FindStringSubmatch(text); m != nil {
+		return s.call(m[1], m[2])
+	}
+
+	cmd, rest := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		cmd, rest = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	fields := strings.Fields(rest)
+
+	switch cmd {
+	case "help":
+		fmt.Fprint(s.out, replHelp)
+		return nil
+	case "def":
+		return s.define(rest)
+	case "defs":
+		return s.defs()
+	case "alloc":
+		if len(fields) != 2 {
+			return errors.New("usage: alloc <name> <size>")
+		}
+		return s.alloc(fields[0], fields[1])
+	case "free":
+		if len(fields) != 1 {
+			return errors.New("usage: free <name>")
+		}
+		return s.free(fields[0])
+	case "sym":
+		if len(fields) != 2 {
+			return errors.New("usage: sym <name> <type>")
+		}
+		return s.symbol(fields[0], fields[1])
+	case "dump":
+		if len(fields) < 1 || len(fields) > 2 {
+			return errors.New("usage: dump <$var|address> [n]")
+		}
+		return s.dump(fields)
+	case "addr":
+		if len(fields) != 1 {
+			return errors.New("usage: addr <$var|address>")
+		}
+		return s.addr(fields[0])
+	case "symbols":
+		prefix := ""
+		if len(fields) > 0 {
+			prefix = fields[0]
+		}
+		for _, name := range s.exports {
+			if strings.HasPrefix(name, prefix) {
+				fmt.Fprintln(s.out, name)
+			}
+		}
+		return nil
+	case "vars":
+		return s.vars()
+	default:
+		return fmt.Errorf("unknown command %q (type help)", cmd)
+	}
+}
+
+func (s *session) define(def string) error {
+	routine, err := dl.ParseRoutineDefinition(def)
+	if err != nil {
+		return err
+	}
+
+	if err := s.lib.Define(routine); err != nil {
+		return err
+	}
+
+	s.routines[routine.Name] = routine
+	return nil
+}
+
+func (s *session) defs() error {
+	names := make([]string, 0, len(s.routines))
+	for name := range s.routines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		routine := s.routines[name]
+		args := make([]string, len(routine.Args))
+		for ii, arg := range routine.Args {
+			args[ii] = formatArg(arg)
+		}
+		res := "void"
+		if routine.Result != nil {
+			res = formatArg(routine.Result)
+		}
+		fmt.Fprintf(s.out, "%s %s(%s)\n", res, name, strings.Join(args, ", "))
+	}
+
+	return nil
+}
+
+func formatArg(arg *dl.Arg) string {
+	typ := arg.Type.String()
+	if arg.Type == reflect.UnsafePointer {
+		typ = "void"
+	}
+	if arg.Pointer {
+		return typ + " *"
+	}
+	return typ
+}
+
+func (s *session) call(name, text string) error {
+	routine, ok := s.routines[name]
+	if !ok {
+		return fmt.Errorf("routine %s is not defined (use def)", name)
+	}
+
+	tokens, err := splitArgs(text)
+	if err != nil {
+		return err
+	}
+	if len(tokens) != len(routine.Args) {
+		return fmt.Errorf("%s expects %d arguments, got %d", name, len(routine.Args), len(tokens))
+	}
+
+	args := make([]interface{}, len(tokens))
+	for ii, token := range tokens {
+		args[ii], err = s.value(routine.Args[ii], token)
+		if err != nil {
+			return fmt.Errorf("argument %d: %w", ii, err)
+		}
+	}
+
+	res, err := s.lib.Call(name, args...)
+	if err != nil {
+		return err
+	}
+	if routine.Result == nil {
+		return nil
+	}
+
+	s.results++
+	key := strconv.Itoa(s.results)
+	s.values[key] = res
+	s.values["_"] = res
+	fmt.Fprintf(s.out, "$%s = %s\n", key, formatValue(res))
+
+	return nil
+}
+
+// value converts literal or variable into argument value
+func (s *session) value(arg *dl.Arg, token string) (interface{}, error) {
+	switch {
+	case token == "null":
+		return address(0), nil
+	case strings.HasPrefix(token, "\""):
+		return strconv.Unquote(token)
+	case strings.HasPrefix(token, "$"):
+		name := token[1:]
+		if m, ok := s.buffers[name]; ok {
+			return m, nil
+		}
+		v, ok := s.values[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %s", token)
+		}
+		if p, ok := pointerOf(v); ok {
+			return address(p), nil
+		}
+		return v, nil
+	default:
+		return parseLiteral(arg, token)
+	}
+}
+
+func (s *session) alloc(name, size string) error {
+	n, err := strconv.ParseUint(size, 0, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", size)
+	}
+
+	m, err := dl.Alloc(uintptr(n))
+	if err != nil {
+		return err
+	}
+
+	if old, ok := s.buffers[name]; ok {
+		old.Free()
+	}
+	s.buffers[name] = m
+	fmt.Fprintf(s.out, "$%s = %#x (%d bytes)\n", name, uintptr(m.Pointer()), n)
+
+	return nil
+}
+
+func (s *session) free(name string) error {
+	m, ok := s.buffers[strings.TrimPrefix(name, "$")]
+	if !ok {
+		return fmt.Errorf("unknown buffer %s", name)
+	}
+
+	m.Free()
+	delete(s.buffers, strings.TrimPrefix(name, "$"))
+	return nil
+}
+
+var symbolTypes = map[string]reflect.Type{
+	"int8":    reflect.TypeOf(int8(0)),
+	"int16":   reflect.TypeOf(int16(0)),
+	"int32":   reflect.TypeOf(int32(0)),
+	"int64":   reflect.TypeOf(int64(0)),
+	"int":     reflect.TypeOf(int(0)),
+	"uint8":   reflect.TypeOf(uint8(0)),
+	"uint16":  reflect.TypeOf(uint16(0)),
+	"uint32":  reflect.TypeOf(uint32(0)),
+	"uint64":  reflect.TypeOf(uint64(0)),
+	"uint":    reflect.TypeOf(uint(0)),
+	"float32": reflect.TypeOf(float32(0)),
+	"float64": reflect.TypeOf(float64(0)),
+	"string":  reflect.TypeOf(""),
+	"pointer": reflect.TypeOf(unsafe.Pointer(nil)),
+}
+
+func (s *session) symbol(name, typ string) error {
+	t, ok := symbolTypes[typ]
+	if !ok {
+		return fmt.Errorf("unsupported type %q", typ)
+	}
+
+	out := reflect.New(t)
+	if err := s.lib.Symbol(name, out.Interface()); err != nil {
+		return err
+	}
+
+	res := out.Elem().Interface()
+	s.results++
+	key := strconv.Itoa(s.results)
+	s.values[key] = res
+	s.values["_"] = res
+	fmt.Fprintf(s.out, "$%s = %s\n", key, formatValue(res))
+
+	return nil
+}
+
+func (s *session) dump(fields []string) error {
+	p, limit, err := s.pointer(fields[0])
+	if err != nil {
+		return err
+	}
+	size := uint64(64)
+	if len(fields) > 1 {
+		n, err := strconv.ParseUint(fields[1], 0, 32)
+		if err != nil {
+			return fmt.Errorf("invalid size %q", fields[1])
+		}
+		size = n
+	}
+	// Size of buffer is known, don't read beyond it
+	if limit != 0 && limit < size {
+		size = limit
+	}
+	if p == 0 {
+		return errors.New("NULL pointer")
+	}
+
+	data, err := dl.ReadMemory(p, uintptr(size))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%#x:\n%s", p, hex.Dump(data))
+	return nil
+}
+
+// pointer resolves buffer, pointer variable or numeric address.
+// Size is known for buffers only.
+func (s *session) pointer(token string) (p uintptr, size uint64, err error) {
+	if !strings.HasPrefix(token, "$") {
+		n, err := strconv.ParseUint(token, 0, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid address %q", token)
+		}
+		return uintptr(n), 0, nil
+	}
+
+	if m, ok := s.buffers[token[1:]]; ok {
+		return uintptr(m.Pointer()), uint64(m.Size()), nil
+	}
+	v, ok := s.values[token[1:]]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown variable %s", token)
+	}
+	p, ok = pointerOf(v)
+	if !ok {
+		return 0, 0, fmt.Errorf("%s is not a pointer", token)
+	}
+	return p, 0, nil
+}
+
+// addr prints library and symbol containing the address
+func (s *session) addr(token string) error {
+	p, _, err := s.pointer(token)
+	if err != nil {
+		return err
+	}
+
+	loc, err := dl.Addr(p)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%#x: %s (%s)\n", p, loc, loc.Library)
+	return nil
+}
+
+func (s *session) vars() error {
+	names := make([]string, 0, len(s.buffers))
+	for name := range s.buffers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		m := s.buffers[name]
+		fmt.Fprintf(s.out, "$%s = %#x (%d bytes)\n", name, uintptr(m.Pointer()), m.Size())
+	}
+
+	for ii := 1; ii <= s.results; ii++ {
+		key := strconv.Itoa(ii)
+		fmt.Fprintf(s.out, "$%s = %s\n", key, formatValue(s.values[key]))
+	}
+
+	return nil
+}
+
+// complete completes names of commands, symbols, routines and variables
+func (s *session) complete(line string, pos int) (head string, completions []string, tail string) {
+	start := strings.LastIndexAny(line[:pos], " \t(,") + 1
+	head, word, tail := line[:start], line[start:pos], line[pos:]
+
+	var candidates []string
+	if strings.HasPrefix(word, "$") {
+		for name := range s.buffers {
+			candidates = append(candidates, "$"+name)
+		}
+		for name := range s.values {
+			candidates = append(candidates, "$"+name)
+		}
+	} else if strings.TrimSpace(head) == "" {
+		candidates = append(candidates, "def", "defs", "alloc", "free", "sym", "dump", "addr", "symbols", "vars", "help", "quit")
+		for name := range s.routines {
+			candidates = append(candidates, name+"(")
+		}
+	} else {
+		candidates = s.exports
+	}
+
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			completions = append(completions, c)
+		}
+	}
+	sort.Strings(completions)
+
+	return head, completions, tail
+}
+
+// splitArgs splits comma separated arguments respecting quoted strings
+func splitArgs(text string) ([]string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return nil, nil
+	}
+
+	var res []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			res = append(res, strings.TrimSpace(cur.String()))
+			cur.Reset()
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if quoted {
+		return nil, errors.New("unterminated string")
+	}
+
+	return append(res, strings.TrimSpace(cur.String())), nil
+}
+
+// pointerOf returns address held by pointer value
+func pointerOf(v interface{}) (uintptr, bool) {
+	switch p := v.(type) {
+	case address:
+		return uintptr(p), true
+	case uintptr:
+		return p, true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.UnsafePointer:
+		return rv.Pointer(), true
+	}
+
+	return 0, false
+}
+
+func formatValue(v interface{}) string {
+	if p, ok := v.(*string); ok {
+		if p == nil {
+			return "NULL"
+		}
+		return strconv.Quote(*p)
+	}
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	if p, ok := pointerOf(v); ok {
+		return fmt.Sprintf("%#x (%T)", p, v)
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,83 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		text string
+		args []string
+		err  bool
+	}{
+		{text: "", args: nil},
+		{text: "-5", args: []string{"-5"}},
+		{text: " 1 , 0x10,$buf ", args: []string{"1", "0x10", "$buf"}},
+		{text: `"a, b", 2`, args: []string{`"a, b"`, "2"}},
+		{text: `"say \"hi\"", null`, args: []string{`"say \"hi\""`, "null"}},
+		{text: `"open`, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			args, err := splitArgs(tt.text)
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.args, args)
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	var out bytes.Buffer
+	s, err := newSession("libc", &out)
+	require.NoError(t, err)
+	defer s.close()
+
+	tests := []struct {
+		line   string
+		output string
+		err    bool
+	}{
+		{line: "def int abs(int)"},
+		{line: "abs(-5)", output: "$1 = 5\n"},
+		{line: "abs(0x10)", output: "$2 = 16\n"},
+		{line: "def uint strlen(string)"},
+		{line: `strlen("a, b")`, output: "$3 = 4\n"},
+		{line: "abs(five)", err: true},
+		{line: "abs(1, 2)", err: true},
+		{line: "labs(1)", err: true},
+		{line: "alloc buf 4"},
+		{line: "dump null", err: true},
+		{line: "dump 0x10", err: true},
+		{line: "addr 0x10", err: true},
+		{line: "unknown", err: true},
+	}
+
+	for _, tt := range tests {
+		out.Reset()
+		err := s.exec(tt.line)
+		if tt.err {
+			assert.Error(t, err, tt.line)
+			continue
+		}
+		require.NoError(t, err, tt.line)
+		if tt.output != "" {
+			assert.Equal(t, tt.output, out.String(), tt.line)
+		}
+	}
+
+	// Dump reads buffer up to its size
+	out.Reset()
+	require.NoError(t, s.exec("dump $buf 64"))
+	assert.Contains(t, out.String(), "00000000  ")
+	assert.NotContains(t, out.String(), "00000010  ")
+}
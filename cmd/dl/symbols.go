@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/adverax/dl"
+)
+
+func runSymbols(args []string) error {
+	fs, asJSON := newFlags("symbols")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errFailed{}
+	}
+
+	path, err := dl.Find(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	exports, err := dl.Exports(path)
+	if err != nil {
+		return err
+	}
+
+	return output(*asJSON, exports, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 8, 1, ' ', 0)
+		for _, e := range exports {
+			name := e.Name
+			if e.Version != "" {
+				name += "@" + e.Version
+			}
+			weak := ""
+			if e.Weak {
+				weak = "weak"
+			}
+			fmt.Fprintf(tw, "%016x\t%s\t%s\t%s\n", e.Value, e.Type, weak, name)
+		}
+		tw.Flush()
+	})
+}
@@ -0,0 +1,222 @@
+package dl
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+
+	"github.com/adverax/echo/generic"
+)
+
+// Conversion is a policy of converting Call arguments into types of the definition
+type Conversion int
+
+const (
+	// ConvertLenient allows any conversion supported by generic.ConvertAssign,
+	// like string "12" into int (default)
+	ConvertLenient Conversion = iota
+	// ConvertChecked allows numeric conversions, which are lossless.
+	// Values out of range are reported with strconv.ErrRange.
+	ConvertChecked
+	// ConvertStrict requires Go kind of argument to match the definition
+	ConvertStrict
+)
+
+func (c Conversion) String() string {
+	switch c {
+	case ConvertLenient:
+		return "lenient"
+	case ConvertChecked:
+		return "checked"
+	case ConvertStrict:
+		return "strict"
+	default:
+		return fmt.Sprintf("Conversion(%d)", int(c))
+	}
+}
+
+// Converter converts value of custom Go type into value, which is passed
+// as the argument (and converted further according to the policy)
+type Converter func(v interface{}, arg *Arg) (interface{}, error)
+
+// WithConversion sets policy of argument conversion
+func WithConversion(policy Conversion) Option {
+	return func(cfg *config) {
+		cfg.conversion = policy
+	}
+}
+
+// WithConverter registers converter of arguments of the same Go type
+// as sample, for example time.Time{} into time_t:
+//
+//	dl.WithConverter(time.Time{}, func(v interface{}, arg *dl.Arg) (interface{}, error) {
+//		return v.(time.Time).Unix(), nil
+//	})
+func WithConverter(sample interface{}, converter Converter) Option {
+	return func(cfg *config) {
+		if cfg.converters == nil {
+			cfg.converters = make(map[reflect.Type]Converter)
+		}
+		cfg.converters[reflect.TypeOf(sample)] = converter
+	}
+}
+
+// custom applies converter registered for type of the argument
+func (cfg *config) custom(arg *Arg, argument interface{}) (interface{}, error) {
+	if len(cfg.converters) == 0 {
+		return argument, nil
+	}
+	converter, ok := cfg.converters[reflect.TypeOf(argument)]
+	if !ok {
+		return argument, nil
+	}
+	return converter(argument, arg)
+}
+
+// convert converts argument into type of the definition according to the policy
+func (cfg *config) convert(arg *Arg, argument interface{}) (interface{}, error) {
+	return Convert(cfg.conversion, arg, argument)
+}
+
+// Convert converts argument into type of the definition according to the
+// policy, the same way as Call does (custom converters are not applied).
+// It might be used by implementations of Library, like test doubles.
+func Convert(policy Conversion, arg *Arg, argument interface{}) (interface{}, error) {
+	if (arg.Type == reflect.UnsafePointer || arg.Pointer) && reflect.ValueOf(argument).Kind() == reflect.Uintptr {
+		// Addresses (like Handle or C memory) are passed to pointers as integers
+		return argument, nil
+	}
+
+	switch policy {
+	case ConvertStrict:
+		return convertStrict(arg, argument)
+	case ConvertChecked:
+		return convertChecked(arg, argument)
+	}
+
+	val := MakeValue(arg.Type, arg.Pointer)
+	if err := generic.ConvertAssign(&val, argument); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// convertStrict accepts values of the same kind only
+func convertStrict(arg *Arg, argument interface{}) (interface{}, error) {
+	v := reflect.ValueOf(argument)
+	typ := reflect.TypeOf(MakeValue(arg.Type, false))
+	if !v.IsValid() {
+		if arg.Pointer || arg.Type == reflect.UnsafePointer {
+			// NULL
+			return nil, nil
+		}
+		return nil, fmt.Errorf("nil can't be passed as %s", typ)
+	}
+
+	if arg.Pointer {
+		// Pointer or slice of values of the kind is passed as is
+		if (v.Kind() == reflect.Ptr || v.Kind() == reflect.Slice) && v.Type().Elem().Kind() == arg.Type {
+			return argument, nil
+		}
+		if arg.Type == reflect.UnsafePointer && (v.Kind() == reflect.UnsafePointer || v.Kind() == reflect.Ptr) {
+			return argument, nil
+		}
+		return nil, fmt.Errorf("%T is not a pointer to %s", argument, typ)
+	}
+
+	if v.Kind() != arg.Type {
+		return nil, fmt.Errorf("%T is not %s", argument, typ)
+	}
+	return v.Convert(typ).Interface(), nil
+}
+
+// convertChecked allows lossless numeric conversions
+func convertChecked(arg *Arg, argument interface{}) (interface{}, error) {
+	v := reflect.ValueOf(argument)
+	if arg.Pointer || !v.IsValid() || !isNumeric(arg.Type) || !isNumeric(v.Kind()) {
+		return convertStrict(arg, argument)
+	}
+
+	res := reflect.New(reflect.TypeOf(MakeValue(arg.Type, false))).Elem()
+	lost := func() error {
+		return fmt.Errorf("%w: %v can't be represented as %s", strconv.ErrRange, argument, res.Type())
+	}
+
+	switch {
+	case isInt(v.Kind()):
+		x := v.Int()
+		switch {
+		case isInt(res.Kind()):
+			if res.OverflowInt(x) {
+				return nil, lost()
+			}
+			res.SetInt(x)
+		case isUint(res.Kind()):
+			if x < 0 || res.OverflowUint(uint64(x)) {
+				return nil, lost()
+			}
+			res.SetUint(uint64(x))
+		default:
+			res.SetFloat(float64(x))
+			if f := res.Float(); f >= math.MaxInt64 || int64(f) != x {
+				return nil, lost()
+			}
+		}
+	case isUint(v.Kind()):
+		u := v.Uint()
+		switch {
+		case isInt(res.Kind()):
+			if u > math.MaxInt64 || res.OverflowInt(int64(u)) {
+				return nil, lost()
+			}
+			res.SetInt(int64(u))
+		case isUint(res.Kind()):
+			if res.OverflowUint(u) {
+				return nil, lost()
+			}
+			res.SetUint(u)
+		default:
+			res.SetFloat(float64(u))
+			if f := res.Float(); f >= math.MaxUint64 || uint64(f) != u {
+				return nil, lost()
+			}
+		}
+	default:
+		f := v.Float()
+		switch {
+		case isInt(res.Kind()):
+			if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || res.OverflowInt(int64(f)) {
+				return nil, lost()
+			}
+			res.SetInt(int64(f))
+		case isUint(res.Kind()):
+			if f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || res.OverflowUint(uint64(f)) {
+				return nil, lost()
+			}
+			res.SetUint(uint64(f))
+		default:
+			if res.OverflowFloat(f) {
+				return nil, lost()
+			}
+			res.SetFloat(f)
+			if g := res.Float(); g != f && !math.IsNaN(f) {
+				return nil, lost()
+			}
+		}
+	}
+
+	return res.Interface(), nil
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	return isInt(kind) || isUint(kind) || kind == reflect.Float32 || kind == reflect.Float64
+}
+
+func isInt(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Int64
+}
+
+func isUint(kind reflect.Kind) bool {
+	return kind >= reflect.Uint && kind <= reflect.Uintptr
+}
@@ -0,0 +1,63 @@
+package dl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestConversion(t *testing.T) {
+	type mode int32
+	type Test struct {
+		policy   Conversion
+		arg      *Arg
+		value    interface{}
+		expected interface{}
+		err      bool
+	}
+
+	int32Arg := &Arg{Type: reflect.Int32}
+	tests := map[string]Test{
+		"Lenient string":          {policy: ConvertLenient, arg: int32Arg, value: "12", expected: int32(12)},
+		"Strict string":           {policy: ConvertStrict, arg: int32Arg, value: "12", err: true},
+		"Strict other int kind":   {policy: ConvertStrict, arg: int32Arg, value: 12, err: true},
+		"Strict named type":       {policy: ConvertStrict, arg: int32Arg, value: mode(3), expected: int32(3)},
+		"Strict pointer":          {policy: ConvertStrict, arg: &Arg{Type: reflect.Int64, Pointer: true}, value: new(int64), expected: new(int64)},
+		"Strict slice":            {policy: ConvertStrict, arg: &Arg{Type: reflect.Uint8, Pointer: true}, value: []byte{1}, expected: []byte{1}},
+		"Strict wrong pointer":    {policy: ConvertStrict, arg: &Arg{Type: reflect.Int64, Pointer: true}, value: new(int32), err: true},
+		"Strict NULL":             {policy: ConvertStrict, arg: &Arg{Type: reflect.UnsafePointer, Pointer: true}, value: nil, expected: nil},
+		"Checked int":             {policy: ConvertChecked, arg: int32Arg, value: 12, expected: int32(12)},
+		"Checked overflow":        {policy: ConvertChecked, arg: int32Arg, value: math.MaxInt32 + 1, err: true},
+		"Checked negative uint":   {policy: ConvertChecked, arg: &Arg{Type: reflect.Uint8}, value: -1, err: true},
+		"Checked uint":            {policy: ConvertChecked, arg: &Arg{Type: reflect.Int64}, value: uint64(7), expected: int64(7)},
+		"Checked big uint":        {policy: ConvertChecked, arg: &Arg{Type: reflect.Int64}, value: uint64(math.MaxUint64), err: true},
+		"Checked integral float":  {policy: ConvertChecked, arg: &Arg{Type: reflect.Int16}, value: 3.0, expected: int16(3)},
+		"Checked fraction":        {policy: ConvertChecked, arg: &Arg{Type: reflect.Int16}, value: 3.5, err: true},
+		"Checked int to float32":  {policy: ConvertChecked, arg: &Arg{Type: reflect.Float32}, value: 1 << 24, expected: float32(1 << 24)},
+		"Checked inexact float32": {policy: ConvertChecked, arg: &Arg{Type: reflect.Float32}, value: 1<<24 + 1, err: true},
+		"Checked float64":         {policy: ConvertChecked, arg: &Arg{Type: reflect.Float32}, value: 0.5, expected: float32(0.5)},
+		"Checked lossy float64":   {policy: ConvertChecked, arg: &Arg{Type: reflect.Float32}, value: 0.1, err: true},
+		"Checked string":          {policy: ConvertChecked, arg: int32Arg, value: "12", err: true},
+		"Checked bool":            {policy: ConvertChecked, arg: &Arg{Type: reflect.Bool}, value: true, expected: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := newConfig([]Option{WithConversion(test.policy)})
+			actual, err := cfg.convert(test.arg, test.value)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+
+	cfg := newConfig([]Option{WithConversion(ConvertChecked)})
+	_, err := cfg.convert(int32Arg, int64(math.MaxInt64))
+	assert.ErrorIs(t, err, strconv.ErrRange)
+}
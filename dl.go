@@ -2,6 +2,7 @@ package dl
 
 import "C"
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"regexp"
@@ -10,8 +11,6 @@ import (
 	"unsafe"
 )
 
-// Todo: rewrite error generation
-
 type Library interface {
 	// Close library
 	Close() error
@@ -21,11 +20,43 @@ type Library interface {
 	Define(routine *Routine) error
 	// Get symbol (not implemented for windows yet)
 	Symbol(name string, out interface{}) error
+	// Verify defined routines against debug info (not implemented for windows)
+	Verify() error
+	// Describe loaded library (not implemented for windows)
+	Info() (*Info, error)
+	// Make handle of Go value, which is deleted on Close
+	NewHandle(v interface{}) Handle
+	// Add interceptors of calls (Call and functions retrieved by Symbol)
+	Use(interceptors ...Interceptor)
+	// Statistics of calls by routine name
+	Stats() map[string]RoutineStats
 }
 
+// Ownership of memory returned by routine. Only string results may be owned,
+// owned pointers aren't supported.
+type Ownership int
+
+const (
+	// Memory belongs to the library: result is copied only
+	Borrowed Ownership = iota
+	// Memory belongs to the caller: result is copied and released with free()
+	OwnedFree
+	// Memory belongs to the caller: result is copied and released
+	// with the Arg.Deallocator routine of the same library
+	OwnedDeallocator
+)
+
 type Arg struct {
 	Type    reflect.Kind
 	Pointer bool
+	// Go struct describing C structure (reflect.Struct only).
+	// Optional for arguments, which accept pointer or slice of any struct.
+	Struct reflect.Type
+	// Ownership of returned memory (results only).
+	// Applicable to string results, which are copied into Go memory.
+	Ownership Ownership
+	// Name of deallocator routine (OwnedDeallocator only)
+	Deallocator string
 }
 
 type Routine struct {
@@ -34,6 +65,151 @@ type Routine struct {
 	Args    []*Arg
 	handle  unsafe.Pointer
 	address uintptr
+	dealloc uintptr
+}
+
+// owned returns true, if routine result must be released after copying
+func (routine *Routine) owned() bool {
+	return routine != nil && routine.Result != nil && routine.Result.Ownership != Borrowed
+}
+
+// goType returns Go type of the result value
+func (arg *Arg) goType() reflect.Type {
+	if arg.Type == reflect.Struct {
+		return reflect.PtrTo(arg.Struct)
+	}
+
+	return reflect.TypeOf(MakeValue(arg.Type, arg.Pointer))
+}
+
+// Validate checks definition of the routine: supported kinds of arguments
+// and result, pointer combinations, struct layouts and ownership of the result.
+// It is called by Define.
+func (routine *Routine) Validate() error {
+	if routine == nil {
+		return errors.New("routine is nil")
+	}
+	if routine.Name == "" {
+		return errors.New("routine name is empty")
+	}
+	for ii, arg := range routine.Args {
+		if err := checkArg(arg, false); err != nil {
+			return fmt.Errorf("argument %d: %w", ii, err)
+		}
+		if arg.Ownership != Borrowed {
+			return fmt.Errorf("argument %d: ownership is applicable to result only", ii)
+		}
+	}
+	if routine.Result != nil {
+		if err := checkArg(routine.Result, true); err != nil {
+			return fmt.Errorf("result: %w", err)
+		}
+	}
+	if err := checkOwnership(routine.Result); err != nil {
+		return err
+	}
+
+	return checkStructs(routine)
+}
+
+// checkArg validates kind of argument or result
+func checkArg(arg *Arg, result bool) error {
+	if arg == nil {
+		return errors.New("type is not specified")
+	}
+	if arg.Struct != nil && arg.Type != reflect.Struct {
+		return fmt.Errorf("struct type is specified for %s", arg.Type)
+	}
+
+	switch arg.Type {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Struct, reflect.UnsafePointer:
+		return nil
+	case reflect.String:
+		if arg.Pointer && !result {
+			return errors.New("string can't be passed by pointer")
+		}
+		return nil
+	case reflect.Invalid:
+		if result && !arg.Pointer {
+			// void
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unsupported type %s", formatArg(arg))
+}
+
+// checkStructs validates struct arguments and result of the routine
+func checkStructs(routine *Routine) error {
+	check := func(arg *Arg) error {
+		if arg.Type != reflect.Struct {
+			return nil
+		}
+		if !arg.Pointer {
+			return errors.New("structs might be passed by pointer only")
+		}
+		if arg.Struct == nil {
+			return nil
+		}
+		_, err := layoutOf(arg.Struct)
+		return err
+	}
+
+	for ii, arg := range routine.Args {
+		if err := check(arg); err != nil {
+			return fmt.Errorf("argument %d: %w", ii, err)
+		}
+	}
+
+	if res := routine.Result; res != nil && res.Type == reflect.Struct {
+		if res.Struct == nil {
+			return errors.New("result: struct type is not specified")
+		}
+		if err := check(res); err != nil {
+			return fmt.Errorf("result: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// structValue validates pointer or slice of structs passed as struct argument
+func structValue(arg *Arg, argument interface{}) (reflect.Value, error) {
+	v := reflect.ValueOf(argument)
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return v, fmt.Errorf("pointer or slice of struct required, not %T", argument)
+	}
+	if arg.Struct != nil && v.Type().Elem() != arg.Struct {
+		return v, fmt.Errorf("%s required, not %T", arg.Struct, argument)
+	}
+
+	return v, nil
+}
+
+// checkOwnership allows ownership of string results only: they are copied
+// into Go memory and the original is released, so nothing owned is returned
+func checkOwnership(res *Arg) error {
+	if res == nil || res.Ownership == Borrowed {
+		return nil
+	}
+	if res.Type != reflect.String {
+		return fmt.Errorf("ownership of %s result is not supported", res.Type)
+	}
+	switch res.Ownership {
+	case OwnedFree:
+		return nil
+	case OwnedDeallocator:
+		if res.Deallocator == "" {
+			return errors.New("deallocator is not specified")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown ownership %d", res.Ownership)
+	}
 }
 
 type rFunc func([]reflect.Value) []reflect.Value
@@ -45,7 +221,7 @@ var (
 
 var (
 	funcRe = regexp.MustCompile(`(\w+)\s+(\*?)\s*([_\w\d]+)\(([^)]*)\)`)
-	argsRe = regexp.MustCompile(`(\w+)\s+(\*?)\s*([_\w\d]+)`)
+	argsRe = regexp.MustCompile(`^\s*(\w+)\s*(\*?)\s*([_\w\d]*)\s*$`)
 	types  = map[string]reflect.Kind{
 		"bool":    reflect.Bool,
 		"int":     reflect.Int,
@@ -61,6 +237,7 @@ var (
 		"float32": reflect.Float32,
 		"float64": reflect.Float64,
 		"string":  reflect.String,
+		"struct":  reflect.Struct,
 		"void":    reflect.UnsafePointer,
 	}
 )
@@ -69,41 +246,53 @@ var (
 // signature in C format
 // For example:
 //   void diskSize(string device, int64 *size)
+// Names of arguments are optional:
+//   int abs(int)
 func ParseRoutineDefinition(def string) (*Routine, error) {
-	matches := funcRe.FindStringSubmatch(def)
-	if len(matches) < 3 {
-		return nil, nil
+	matches := funcRe.FindStringSubmatchIndex(def)
+	if matches == nil {
+		return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{Definition: def, Msg: "invalid routine definition"})
+	}
+	if strings.TrimSpace(def[:matches[0]]) != "" {
+		return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{Definition: def, Msg: "unexpected text before definition"})
+	}
+	if rest := strings.TrimSpace(def[matches[1]:]); rest != "" && rest != ";" {
+		return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{Definition: def, Pos: matches[1], Msg: "unexpected text after definition"})
 	}
 
-	typ := matches[1]
-	ptr := matches[2]
-	name := matches[3]
+	typ := def[matches[2]:matches[3]]
+	ptr := def[matches[4]:matches[5]]
+	name := def[matches[6]:matches[7]]
 	var arguments []string
-	s := strings.TrimSpace(matches[4])
-	if s != "" {
+	s := def[matches[8]:matches[9]]
+	if strings.TrimSpace(s) != "" {
 		arguments = strings.Split(s, ",")
 	}
 	args := make([]*Arg, 0, len(arguments))
+	pos := matches[8] // offset of the current argument
 	for i, arg := range arguments {
-		matches := argsRe.FindStringSubmatch(arg)
-		if len(matches) < 2 {
-			return nil, fmt.Errorf("error in %d argument", i)
+		m := argsRe.FindStringSubmatchIndex(arg)
+		if m == nil {
+			return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: def,
+				Pos:        pos + len(arg) - len(strings.TrimLeft(arg, " \t")),
+				Msg:        fmt.Sprintf("error in %d argument", i),
+			})
 		}
-		typ := matches[1]
-		ptr := matches[2]
-		a, err := newArg(typ, ptr == "*")
+		a, err := newArg(arg[m[2]:m[3]], arg[m[4]:m[5]] == "*")
 		if err != nil {
-			return nil, fmt.Errorf("ParseRoutineDefinition: %w", err)
+			return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{Definition: def, Pos: pos + m[2], Msg: err.Error()})
 		}
 		args = append(args, a)
+		pos += len(arg) + 1
 	}
 
 	var res *Arg
-	if typ != "void" {
+	if typ != "void" || ptr == "*" {
 		var err error
 		res, err = newArg(typ, ptr == "*")
 		if err != nil {
-			return nil, fmt.Errorf("ParseRoutineDefinition: %w", err)
+			return nil, fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{Definition: def, Pos: matches[2], Msg: err.Error()})
 		}
 	}
 
@@ -129,8 +318,9 @@ func newArg(typ string, ptr bool) (*Arg, error) {
 func OpenEx(
 	filename string,
 	routines []string,
+	options ...Option,
 ) (Library, error) {
-	lib, err := Open(filename, 0)
+	lib, err := Open(filename, 0, options...)
 	if err != nil {
 		return nil, fmt.Errorf("OpenEx: %w", err)
 	}
@@ -5,7 +5,10 @@ package dl
 import "C"
 
 /*#cgo LDFLAGS: -ldl
+#define _GNU_SOURCE
 #include <dlfcn.h>
+#include <link.h>
+#include <stdint.h>
 #include <stdlib.h>
 #include <string.h>
 
@@ -73,18 +76,28 @@ int call(void *f, void **args, int *flags, int count, void **out)
     *out = make_call(f, integers, floats_ptr, stack_count, stack, flags[count] & ARG_FLAG_FLOAT);
     return 0;
 }
+
+static void *c_pointer(uintptr_t addr)
+{
+    return (void *)addr;
+}
 */
 import "C"
 
 import (
+	"context"
+	"debug/elf"
 	"errors"
 	"fmt"
-	"github.com/adverax/echo/generic"
 	"math"
+	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"unsafe"
 )
 
@@ -108,56 +121,246 @@ type library struct {
 	sync.Mutex
 	handle   unsafe.Pointer
 	routines map[string]*Routine
+	scope
+	flag int
+	name string // path of the library for events
 }
 
-func (lib *library) Close() error {
+func (lib *library) Close() (err error) {
 	if lib.handle != nil {
+		defer func() {
+			lib.config.emit(Event{Kind: EventClose, Library: lib.name, Err: err})
+		}()
 		lib.Lock()
 		defer lib.Unlock()
 
 		if lib.handle != nil {
 			mu.Lock()
 			defer mu.Unlock()
+			runtime.LockOSThread()
+			defer runtime.UnlockOSThread()
 
 			if C.dlclose(lib.handle) != 0 {
-				return fmt.Errorf("close library: %w", dlerror())
+				return fmt.Errorf("close library: %w", dlerror(nil))
 			}
 			lib.handle = nil
+			lib.pins.unpin()
+			lib.handles.Release()
 		}
 	}
 
 	return nil
 }
 
-func (lib *library) Define(routine *Routine) error {
+func (lib *library) Define(routine *Routine) (err error) {
+	if routine == nil {
+		return errors.New("define: routine is nil")
+	}
+	defer func() {
+		lib.config.emit(Event{Kind: EventDefine, Library: lib.name, Symbol: routine.Name, Err: err})
+	}()
 	lib.Lock()
 	defer lib.Unlock()
 
+	if err := routine.Validate(); err != nil {
+		return fmt.Errorf("define %s: %w", routine.Name, err)
+	}
+
+	if lib.handle == nil {
+		return fmt.Errorf("define %s: %w", routine.Name, ErrClosed)
+	}
+
 	s := C.CString(routine.Name)
 	defer C.free(unsafe.Pointer(s))
 
-	lib.routines[routine.Name] = routine
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
 	handle := C.dlsym(lib.handle, s)
 	if handle == nil {
-		return dlerror()
+		return fmt.Errorf("define %s: %w", routine.Name, dlerror(ErrSymbolNotFound))
 	}
 
+	var dealloc unsafe.Pointer
+	if routine.Result != nil && routine.Result.Ownership == OwnedDeallocator {
+		d := C.CString(routine.Result.Deallocator)
+		defer C.free(unsafe.Pointer(d))
+
+		dealloc = C.dlsym(lib.handle, d)
+		if dealloc == nil {
+			return fmt.Errorf("define %s: deallocator: %w", routine.Name, dlerror(ErrSymbolNotFound))
+		}
+	}
+
+	// Library and routine are changed only when definition succeeds
 	routine.handle = handle
+	routine.dealloc = uintptr(dealloc)
+	lib.routines[routine.Name] = routine
 
 	return nil
 }
 
+// Verify compares defined routines against DWARF debug info of the library
+func (lib *library) Verify() error {
+	path, err := lib.path()
+	if err != nil {
+		return fmt.Errorf("Verify: %w", err)
+	}
+
+	lib.Lock()
+	routines := make([]*Routine, 0, len(lib.routines))
+	for _, routine := range lib.routines {
+		routines = append(routines, routine)
+	}
+	lib.Unlock()
+	sort.Slice(routines, func(i, j int) bool {
+		return routines[i].Name < routines[j].Name
+	})
+
+	mismatches, err := VerifyRoutines(path, routines...)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) != 0 {
+		return &VerifyError{Mismatches: mismatches}
+	}
+
+	return nil
+}
+
+// Info returns description of the loaded library
+func (lib *library) Info() (*Info, error) {
+	m, err := lib.linkMap()
+	if err != nil {
+		return nil, fmt.Errorf("Info: %w", err)
+	}
+
+	info := &Info{
+		Path:  loadedPath(m),
+		Base:  uintptr(m.l_addr),
+		Flags: lib.flag,
+	}
+	if f, err := elf.Open(info.Path); err == nil {
+		info.BuildID = buildID(f)
+		if names, _ := f.DynString(elf.DT_SONAME); len(names) != 0 {
+			info.SOName = names[0]
+		}
+		f.Close()
+	}
+
+	var loaded []Loaded
+	for m.l_prev != nil {
+		m = m.l_prev
+	}
+	for ; m != nil; m = m.l_next {
+		loaded = append(loaded, Loaded{Path: loadedPath(m), Base: uintptr(m.l_addr)})
+	}
+	info.LinkMap = dependencies(info.Path, loaded)
+
+	return info, nil
+}
+
+// dependencies filters link map down to the library and objects of its
+// DT_NEEDED closure. Needed names are matched by DT_SONAME or file name.
+func dependencies(path string, loaded []Loaded) []Loaded {
+	index := make(map[string]int, len(loaded))
+	for ii, l := range loaded {
+		index[filepath.Base(l.Path)] = ii
+		if f, err := elf.Open(l.Path); err == nil {
+			if names, _ := f.DynString(elf.DT_SONAME); len(names) != 0 {
+				index[names[0]] = ii
+			}
+			f.Close()
+		}
+	}
+
+	closure := make(map[int]bool)
+	queue := []string{path}
+	for len(queue) != 0 {
+		needed, _ := Needed(queue[0])
+		queue = queue[1:]
+		for _, name := range needed {
+			if ii, ok := index[name]; ok && !closure[ii] {
+				closure[ii] = true
+				queue = append(queue, loaded[ii].Path)
+			}
+		}
+	}
+
+	var res []Loaded
+	for ii, l := range loaded {
+		if l.Path == path || closure[ii] {
+			res = append(res, l)
+		}
+	}
+	return res
+}
+
+// linkMap returns entry of the library in the link map
+func (lib *library) linkMap() (*C.struct_link_map, error) {
+	lib.Lock()
+	handle := lib.handle
+	lib.Unlock()
+	if handle == nil {
+		return nil, ErrClosed
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var m *C.struct_link_map
+	if C.dlinfo(handle, C.RTLD_DI_LINKMAP, unsafe.Pointer(&m)) != 0 || m == nil {
+		return nil, dlerror(nil)
+	}
+	return m, nil
+}
+
+// path returns file name of the loaded library
+func (lib *library) path() (string, error) {
+	m, err := lib.linkMap()
+	if err != nil {
+		return "", err
+	}
+	return loadedPath(m), nil
+}
+
+// loadedPath returns absolute path of the link map entry
+func loadedPath(m *C.struct_link_map) string {
+	name := C.GoString(m.l_name)
+	if name == "" {
+		// Main program
+		name, _ = os.Executable()
+	}
+	if filepath.IsAbs(name) || !strings.ContainsRune(name, '/') {
+		return name
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		return abs
+	}
+	return name
+}
+
 func (lib *library) Symbol(name string, out interface{}) error {
 	s := C.CString(name)
 	defer C.free(unsafe.Pointer(s))
 
+	lib.Lock()
+	handle := lib.handle
+	lib.Unlock()
+	if handle == nil {
+		return fmt.Errorf("symbol: %w", ErrClosed)
+	}
+
 	mu.Lock()
-	handle := C.dlsym(lib.handle, s)
+	runtime.LockOSThread()
+	handle = C.dlsym(handle, s)
 	if handle == nil {
-		err := dlerror()
+		err := dlerror(ErrSymbolNotFound)
+		runtime.UnlockOSThread()
 		mu.Unlock()
 		return fmt.Errorf("symbol: %w", err)
 	}
+	runtime.UnlockOSThread()
 	mu.Unlock()
 
 	val := reflect.ValueOf(out)
@@ -201,16 +404,35 @@ func (lib *library) Symbol(name string, out interface{}) error {
 	case reflect.Float64:
 		elem.SetFloat(float64(*(*float64)(handle)))
 	case reflect.Func:
+		// Routine with the same name, if defined, declares ownership of the result
+		lib.Lock()
+		routine := lib.routines[name]
+		lib.Unlock()
 		typ := elem.Type()
-		tr, err := makeTrampoline(typ, handle)
+		tr, err := makeTrampoline(&lib.scope, name, typ, handle, routine)
 		if err != nil {
 			return fmt.Errorf("symbol: %w", err)
 		}
 		v := reflect.MakeFunc(typ, tr)
 		elem.Set(v)
 	case reflect.Ptr:
+		if typ := elem.Type().Elem(); typ.Kind() == reflect.Struct {
+			l, err := layoutOf(typ)
+			if err != nil {
+				return fmt.Errorf("symbol: %w", err)
+			}
+			if !l.inplace {
+				return fmt.Errorf("symbol: layout of %s differs from C one, retrieve a copy instead", typ)
+			}
+		}
 		v := reflect.NewAt(elem.Type().Elem(), handle)
 		elem.Set(v)
+	case reflect.Struct:
+		l, err := layoutOf(elem.Type())
+		if err != nil {
+			return fmt.Errorf("symbol: %w", err)
+		}
+		l.load(handle, elem)
 	case reflect.String:
 		elem.SetString(C.GoString(*(**C.char)(handle)))
 	case reflect.UnsafePointer:
@@ -229,9 +451,86 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 		return nil, fmt.Errorf("call: %w", err)
 	}
 
-	// Prepare arguments
-	var argp *unsafe.Pointer
+	return lib.call(context.Background(), routine, arguments, nil)
+}
+
+// callContext is the same as Call, but passes ctx to interceptors
+func (lib *library) callContext(ctx context.Context, name string, arguments []interface{}) (interface{}, error) {
+	routine, err := lib.find(name)
+	if err != nil {
+		return nil, fmt.Errorf("call: %w", err)
+	}
+
+	return lib.call(ctx, routine, arguments, nil)
+}
+
+// callErrno is the same as Call, but also returns errno set by the routine
+func (lib *library) callErrno(name string, arguments []interface{}) (interface{}, syscall.Errno, error) {
+	routine, err := lib.find(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("call: %w", err)
+	}
+
+	var errno syscall.Errno
+	res, err := lib.call(context.Background(), routine, arguments, &errno)
+	return res, errno, err
+}
+
+// call invokes routine with arguments converted according to its definition.
+// Errno set by the routine is stored into errno, if it is not nil.
+func (sc *scope) call(ctx context.Context, routine *Routine, arguments []interface{}, errno *syscall.Errno) (interface{}, error) {
 	count := len(routine.Args)
+	if len(arguments) != count {
+		return nil, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+
+	// Convert arguments
+	args := make([]interface{}, count)
+	retain := make([]bool, count)
+	for ii, arg := range routine.Args {
+		argument := arguments[ii]
+		if r, ok := argument.(retained); ok {
+			argument, retain[ii] = r.value, true
+		}
+		argument, err := sc.config.custom(arg, argument)
+		if err != nil {
+			return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, arguments[ii], err))
+		}
+
+		if _, ok := argument.(pointer); ok {
+			// C memory is passed as is
+		} else if arg.Type == reflect.Struct {
+			if _, err := structValue(arg, argument); err != nil {
+				return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, argument, err))
+			}
+		} else {
+			val, err := sc.config.convert(arg, argument)
+			if err != nil {
+				return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, argument, err))
+			}
+			argument = val
+		}
+		args[ii] = argument
+	}
+
+	return sc.profile(ctx, routine.Name, func(ctx context.Context) (interface{}, error) {
+		info := CallInfo{Name: routine.Name, Routine: routine, Args: args, Context: ctx}
+		return sc.chain.Invoke(info, func(info CallInfo) (interface{}, error) {
+			return sc.measure(routine.Name, func() (interface{}, error) {
+				return sc.invoke(routine, info.Args, retain, errno)
+			})
+		})
+	})
+}
+
+// invoke calls routine with converted arguments
+func (sc *scope) invoke(routine *Routine, arguments []interface{}, retain []bool, errno *syscall.Errno) (interface{}, error) {
+	count := len(routine.Args)
+	if len(arguments) != count {
+		return nil, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+
+	// Prepare arguments
 	args := make([]unsafe.Pointer, count)
 	flags := make([]C.int, count+1)
 
@@ -244,148 +543,49 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 	}
 	flags[count] = outFlag
 
-	if count > 0 {
-		if len(arguments) < count {
-			return false, fmt.Errorf("call: %w", fmt.Errorf("too few arguments in func %s", routine.Name))
-		}
+	fr := sc.newFrame(routine.Name)
+	defer fr.free()
 
-		for ii, arg := range routine.Args {
-			val := MakeValue(arg.Type, arg.Pointer)
-			err = generic.ConvertAssign(&val, arguments[ii])
-			if err != nil {
-				return nil, fmt.Errorf("call: %w", err)
-			}
-			v := reflect.ValueOf(val)
-			if v.Type() == emptyType {
-				v = reflect.ValueOf(v.Interface())
-			}
+	for ii := 0; ii < count; ii++ {
+		if p, ok := arguments[ii].(pointer); ok {
+			args[ii], flags[ii] = p.Pointer(), C.ARG_FLAG_SIZE_PTR
+			continue
+		}
 
-			switch v.Kind() {
-			case reflect.String:
-				s := C.CString(v.String())
-				defer C.free(unsafe.Pointer(s))
-				args[ii] = unsafe.Pointer(s)
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Int:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				if v.Type().Size() == 4 {
-					flags[ii] = C.ARG_FLAG_SIZE_32
-				} else {
-					flags[ii] = C.ARG_FLAG_SIZE_64
-				}
-			case reflect.Int8:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_8
-			case reflect.Int16:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_16
-			case reflect.Int32:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_32
-			case reflect.Int64:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_64
-			case reflect.Uint:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				if v.Type().Size() == 4 {
-					flags[ii] = C.ARG_FLAG_SIZE_32
-				} else {
-					flags[ii] = C.ARG_FLAG_SIZE_64
-				}
-			case reflect.Uint8:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_8
-			case reflect.Uint16:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_16
-			case reflect.Uint32:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_32
-			case reflect.Uint64:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_64
-			case reflect.Float32:
-				args[ii] = unsafe.Pointer(uintptr(math.Float32bits(float32(v.Float()))))
-				flags[ii] |= C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_32
-			case reflect.Float64:
-				args[ii] = unsafe.Pointer(uintptr(math.Float64bits(v.Float())))
-				flags[ii] |= C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_64
-			case reflect.Ptr:
-				args[ii] = unsafe.Pointer(v.Pointer())
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Slice:
-				if v.Len() > 0 {
-					args[ii] = unsafe.Pointer(v.Index(0).UnsafeAddr())
-				}
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Uintptr:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			default:
-				return false, fmt.Errorf("call: %w", fmt.Errorf("can't bind value of type %s", v.Type()))
-			}
+		v := reflect.ValueOf(arguments[ii])
+		var err error
+		args[ii], flags[ii], err = fr.bind(ii, v)
+		if err != nil {
+			return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, arguments[ii], err))
+		}
+		if retain[ii] {
+			sc.pins.pin(v)
 		}
-		argp = &args[0]
 	}
 
 	// Call routine
-	var ret unsafe.Pointer
-	if C.call(routine.handle, argp, &flags[0], C.int(count), &ret) != 0 {
-		s := C.GoString((*C.char)(ret))
-		C.free(ret)
-		return 0, fmt.Errorf("call: %w", errors.New(s))
+	ret, err := fr.invoke(routine.handle, args, flags)
+	// Arguments like *Memory are passed as raw pointers,
+	// finalizers must not release them during the call
+	runtime.KeepAlive(arguments)
+	if errno != nil {
+		*errno = fr.errno
+	}
+	if err != nil {
+		return 0, fmt.Errorf("call: %w", err)
 	}
 
 	// Prepare result
 	if routine.Result == nil || routine.Result.Type == reflect.Invalid {
-		return
+		return nil, nil
 	}
 
-	var v reflect.Value
-	vv := MakeValue(routine.Result.Type, routine.Result.Pointer)
-	out := reflect.TypeOf(vv)
-
-	switch out.Kind() {
-	case reflect.Int:
-		v = reflect.ValueOf(int(uintptr(ret)))
-	case reflect.Int8:
-		v = reflect.ValueOf(int8(uintptr(ret)))
-	case reflect.Int16:
-		v = reflect.ValueOf(int16(uintptr(ret)))
-	case reflect.Int32:
-		v = reflect.ValueOf(int32(uintptr(ret)))
-	case reflect.Int64:
-		v = reflect.ValueOf(int64(uintptr(ret)))
-	case reflect.Uint:
-		v = reflect.ValueOf(uint(uintptr(ret)))
-	case reflect.Uint8:
-		v = reflect.ValueOf(uint8(uintptr(ret)))
-	case reflect.Uint16:
-		v = reflect.ValueOf(uint16(uintptr(ret)))
-	case reflect.Uint32:
-		v = reflect.ValueOf(uint32(uintptr(ret)))
-	case reflect.Uint64:
-		v = reflect.ValueOf(uint64(uintptr(ret)))
-	case reflect.Float32:
-		v = reflect.ValueOf(math.Float32frombits(uint32(uintptr(ret))))
-	case reflect.Float64:
-		v = reflect.ValueOf(math.Float64frombits(uint64(uintptr(ret))))
-	case reflect.Ptr:
-		if out.Elem().Kind() == reflect.String && ret != nil {
-			s := C.GoString((*C.char)(ret))
-			v = reflect.ValueOf(&s)
-			break
-		}
-		v = reflect.NewAt(out.Elem(), ret)
-	case reflect.String:
-		s := C.GoString((*C.char)(ret))
-		v = reflect.ValueOf(s)
-	case reflect.Uintptr:
-		v = reflect.ValueOf(uintptr(ret))
-	case reflect.UnsafePointer:
-		v = reflect.ValueOf(ret)
-	default:
-		return reflect.Value{}, fmt.Errorf("call: %w", fmt.Errorf("can't retrieve value of type"))
+	v, err := retrieveValue(routine.Result.goType(), ret)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("call: %w", err)
+	}
+	if routine.owned() {
+		release(routine, ret)
 	}
 
 	return v.Interface(), nil
@@ -395,14 +595,18 @@ func (lib *library) find(name string) (*Routine, error) {
 	lib.Lock()
 	defer lib.Unlock()
 
+	if lib.handle == nil {
+		return nil, ErrClosed
+	}
 	if routine, ok := lib.routines[name]; ok {
 		return routine, nil
 	}
 
-	return nil, fmt.Errorf("find: %w", fmt.Errorf("function %q not found", name))
+	return nil, fmt.Errorf("find: %w: %s", ErrSymbolNotFound, name)
 }
 
-func Open(name string, flag int) (l Library, err error) {
+func Open(name string, flag int, options ...Option) (l Library, err error) {
+	cfg := newConfig(options)
 	if flag&RTLD_LAZY == 0 && flag&RTLD_NOW == 0 {
 		flag |= RTLD_NOW
 	}
@@ -412,49 +616,77 @@ func Open(name string, flag int) (l Library, err error) {
 	s := C.CString(name)
 	defer C.free(unsafe.Pointer(s))
 	mu.Lock()
+	runtime.LockOSThread()
 	handle := C.dlopen(s, C.int(flag))
 	if handle == nil {
-		err = dlerror()
+		err = dlerror(nil)
 	}
+	runtime.UnlockOSThread()
 	mu.Unlock()
 	if err != nil {
 		if runtime.GOOS == "linux" && name == "libc.so" {
 			// In most distros libc.so is now a text file
 			// and in order to dlopen() it the name libc.so.6
-			// must be used.
-			return Open(name+".6", flag)
+			// must be used. Event is emitted by the retry,
+			// which decides the outcome.
+			return Open(name+".6", flag, options...)
 		}
+		err = diagnose(name, err.(*loaderError))
+		cfg.emit(Event{Kind: EventOpen, Library: name, Flags: flag, Err: err})
 		return nil, fmt.Errorf("Open: %w", err)
 	}
 
-	l = &library{
+	lib := &library{
 		handle:   handle,
 		routines: make(map[string]*Routine),
+		scope:    scope{config: cfg},
+		flag:     flag,
+		name:     name,
 	}
+	if path, err := lib.path(); err == nil {
+		lib.name = path
+	}
+	lib.publish()
+	cfg.emit(Event{Kind: EventOpen, Library: lib.name, Flags: flag})
 
-	return l, nil
+	return lib, nil
 }
 
-func dlerror() error {
+// dlerror returns the last error of the dynamic loader matched by kind.
+// The error is kept per thread, so OS thread must be locked since dl* call.
+func dlerror(kind error) error {
 	s := C.dlerror()
-	return errors.New(C.GoString(s))
+	if s == nil {
+		return &loaderError{msg: "unknown error", kind: kind}
+	}
+	return &loaderError{msg: C.GoString(s), kind: kind}
+}
+
+// errCall converts error message returned by call into error
+func errCall(msg unsafe.Pointer) error {
+	s := C.GoString((*C.char)(msg))
+	C.free(msg)
+	return errors.New(s)
 }
 
-func makeTrampoline(typ reflect.Type, handle unsafe.Pointer) (rFunc, error) {
+func makeTrampoline(sc *scope, name string, typ reflect.Type, handle unsafe.Pointer, routine *Routine) (rFunc, error) {
 	numOut := typ.NumOut()
 	if numOut > 1 {
 		return nil, fmt.Errorf("makeTranspoline: %w", fmt.Errorf("C functions can return 0 or 1 values, not %d", numOut))
 	}
 	var out reflect.Type
-	var kind reflect.Kind
 	outFlag := C.int(0)
 	if numOut == 1 {
 		out = typ.Out(0)
-		kind = out.Kind()
+		kind := out.Kind()
 		if kind == reflect.Float32 || kind == reflect.Float64 {
 			outFlag |= C.ARG_FLAG_FLOAT
 		}
 	}
+	// Owned memory is released after copying, so it can be retrieved as string only
+	if routine.owned() && (out == nil || out.Kind() != reflect.String) {
+		return nil, fmt.Errorf("makeTranspoline: %w", fmt.Errorf("owned result of %s must be returned as string", name))
+	}
 
 	return func(in []reflect.Value) []reflect.Value {
 		if typ.IsVariadic() && len(in) > 0 {
@@ -467,135 +699,323 @@ func makeTrampoline(typ reflect.Type, handle unsafe.Pointer) (rFunc, error) {
 			}
 		}
 
-		count := len(in)
-		args := make([]unsafe.Pointer, count)
-		flags := make([]C.int, count+1)
-		flags[count] = outFlag
+		args := make([]interface{}, len(in))
 		for ii, v := range in {
-			if v.Type() == emptyType {
-				v = reflect.ValueOf(v.Interface())
+			args[ii] = v.Interface()
+		}
+
+		res, err := sc.profile(context.Background(), name, func(ctx context.Context) (interface{}, error) {
+			info := CallInfo{Name: name, Routine: routine, Args: args, Context: ctx}
+			return sc.chain.Invoke(info, func(info CallInfo) (interface{}, error) {
+				return sc.measure(name, func() (interface{}, error) {
+					return sc.invokeFunc(name, handle, info.Args, out, outFlag, routine)
+				})
+			})
+		})
+		if err != nil {
+			panic(err)
+		}
+		if numOut == 0 {
+			return nil
+		}
+		if res == nil {
+			return []reflect.Value{reflect.Zero(out)}
+		}
+		v := reflect.ValueOf(res)
+		if v.Type() != out {
+			if !v.Type().ConvertibleTo(out) {
+				panic(fmt.Errorf("%s: result %s can't be converted to %s", name, v.Type(), out))
 			}
-			switch v.Kind() {
-			case reflect.String:
-				s := C.CString(v.String())
-				defer C.free(unsafe.Pointer(s))
-				args[ii] = unsafe.Pointer(s)
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Int:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				if v.Type().Size() == 4 {
-					flags[ii] = C.ARG_FLAG_SIZE_32
-				} else {
-					flags[ii] = C.ARG_FLAG_SIZE_64
-				}
-			case reflect.Int8:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_8
-			case reflect.Int16:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_16
-			case reflect.Int32:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_32
-			case reflect.Int64:
-				args[ii] = unsafe.Pointer(uintptr(v.Int()))
-				flags[ii] = C.ARG_FLAG_SIZE_64
-			case reflect.Uint:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				if v.Type().Size() == 4 {
-					flags[ii] = C.ARG_FLAG_SIZE_32
-				} else {
-					flags[ii] = C.ARG_FLAG_SIZE_64
-				}
-			case reflect.Uint8:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_8
-			case reflect.Uint16:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_16
-			case reflect.Uint32:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_32
-			case reflect.Uint64:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] = C.ARG_FLAG_SIZE_64
-			case reflect.Float32:
-				args[ii] = unsafe.Pointer(uintptr(math.Float32bits(float32(v.Float()))))
-				flags[ii] |= C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_32
-			case reflect.Float64:
-				args[ii] = unsafe.Pointer(uintptr(math.Float64bits(v.Float())))
-				flags[ii] |= C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_64
-			case reflect.Ptr:
-				args[ii] = unsafe.Pointer(v.Pointer())
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Slice:
-				if v.Len() > 0 {
-					args[ii] = unsafe.Pointer(v.Index(0).UnsafeAddr())
-				}
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			case reflect.Uintptr:
-				args[ii] = unsafe.Pointer(uintptr(v.Uint()))
-				flags[ii] |= C.ARG_FLAG_SIZE_PTR
-			default:
-				panic(fmt.Errorf("can't bind value of type %s", v.Type()))
+			v = v.Convert(out)
+		}
+		return []reflect.Value{v}
+	}, nil
+}
+
+// invokeFunc calls function retrieved by Symbol or bound to an address
+func (sc *scope) invokeFunc(name string, handle unsafe.Pointer, arguments []interface{}, out reflect.Type, outFlag C.int, routine *Routine) (interface{}, error) {
+	fr := sc.newFrame(name)
+	defer fr.free()
+
+	count := len(arguments)
+	args := make([]unsafe.Pointer, count)
+	flags := make([]C.int, count+1)
+	flags[count] = outFlag
+	for ii, argument := range arguments {
+		var err error
+		args[ii], flags[ii], err = fr.bind(ii, reflect.ValueOf(argument))
+		if err != nil {
+			return nil, &ArgumentError{Routine: name, Index: ii, Want: "C value", Got: fmt.Sprintf("%T", argument), Err: err}
+		}
+	}
+	ret, err := fr.invoke(handle, args, flags)
+	runtime.KeepAlive(arguments)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return nil, nil
+	}
+
+	v, err := retrieveValue(out, ret)
+	if err != nil {
+		return nil, err
+	}
+	if routine.owned() && out.Kind() == reflect.String {
+		release(routine, ret)
+	}
+	return v.Interface(), nil
+}
+
+// frame holds C memory allocated and Go memory pinned
+// for the arguments of a single call
+type frame struct {
+	allocs []unsafe.Pointer
+	copies []*marshaled // C copies of Go structs
+	pinner runtime.Pinner
+	retain *pinset    // pins of retained arguments
+	san    *sanitizer // guarded copies of buffers (sanitizer mode only)
+	errno  syscall.Errno
+}
+
+func (sc *scope) newFrame(name string) *frame {
+	fr := &frame{retain: &sc.pins}
+	if sc.config.sanitize {
+		fr.san = &sanitizer{routine: name}
+	}
+	return fr
+}
+
+func (fr *frame) free() {
+	for _, p := range fr.allocs {
+		C.free(p)
+	}
+	fr.allocs = nil
+	fr.pinner.Unpin()
+	if fr.san != nil {
+		_ = fr.san.restore()
+	}
+}
+
+// invoke calls C function with the bound arguments
+func (fr *frame) invoke(handle unsafe.Pointer, args []unsafe.Pointer, flags []C.int) (ret unsafe.Pointer, err error) {
+	count := len(args)
+	var argp *unsafe.Pointer
+	if count > 0 {
+		argp = &args[0]
+	}
+
+	if fr.san != nil {
+		err = fr.san.call(handle, argp, &flags[0], count, &ret)
+		fr.errno = fr.san.errno
+		if e := fr.san.restore(); err == nil {
+			err = e
+		}
+	} else {
+		// errno is cleared by cgo before the call
+		res, cerr := C.call(handle, argp, &flags[0], C.int(count), &ret)
+		fr.errno, _ = cerr.(syscall.Errno)
+		if res != 0 {
+			err = errCall(ret)
+			ret = nil
+		}
+	}
+
+	for _, m := range fr.copies {
+		m.unmarshal()
+	}
+
+	return ret, err
+}
+
+// alloc allocates zeroed C memory released with the frame
+func (fr *frame) alloc(size uintptr) unsafe.Pointer {
+	p := C.calloc(1, C.size_t(size))
+	fr.allocs = append(fr.allocs, p)
+	return p
+}
+
+// bind converts Go value into the C argument and its flags.
+// Go memory passed by pointer is pinned until the frame is freed.
+func (fr *frame) bind(index int, v reflect.Value) (arg unsafe.Pointer, flag C.int, err error) {
+	if !v.IsValid() {
+		// nil is passed as NULL
+		return nil, C.ARG_FLAG_SIZE_PTR, nil
+	}
+
+	if r, ok := v.Interface().(retained); ok {
+		if fr.retain == nil {
+			return nil, 0, errors.New("retained arguments are not supported")
+		}
+		v = reflect.ValueOf(r.value)
+		if !v.IsValid() {
+			return nil, C.ARG_FLAG_SIZE_PTR, nil
+		}
+		defer func() {
+			if err == nil {
+				fr.retain.pin(v)
 			}
+		}()
+	}
+
+	if p, ok := v.Interface().(pointer); ok {
+		return p.Pointer(), C.ARG_FLAG_SIZE_PTR, nil
+	}
+
+	if err := checkGoPointers(v); err != nil {
+		return nil, 0, err
+	}
+	pinValue(&fr.pinner, v)
+
+	switch v.Kind() {
+	case reflect.Bool:
+		// C _Bool
+		if v.Bool() {
+			return unsafe.Pointer(uintptr(1)), C.ARG_FLAG_SIZE_8, nil
+		}
+		return nil, C.ARG_FLAG_SIZE_8, nil
+	case reflect.String:
+		s := C.CString(v.String())
+		fr.allocs = append(fr.allocs, unsafe.Pointer(s))
+		return unsafe.Pointer(s), C.ARG_FLAG_SIZE_PTR, nil
+	case reflect.Int:
+		if v.Type().Size() == 4 {
+			return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_32, nil
+		}
+		return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_64, nil
+	case reflect.Int8:
+		return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_8, nil
+	case reflect.Int16:
+		return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_16, nil
+	case reflect.Int32:
+		return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_32, nil
+	case reflect.Int64:
+		return unsafe.Pointer(uintptr(v.Int())), C.ARG_FLAG_SIZE_64, nil
+	case reflect.Uint:
+		if v.Type().Size() == 4 {
+			return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_32, nil
+		}
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_64, nil
+	case reflect.Uint8:
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_8, nil
+	case reflect.Uint16:
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_16, nil
+	case reflect.Uint32:
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_32, nil
+	case reflect.Uint64:
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_64, nil
+	case reflect.Float32:
+		return unsafe.Pointer(uintptr(math.Float32bits(float32(v.Float())))), C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_32, nil
+	case reflect.Float64:
+		return unsafe.Pointer(uintptr(math.Float64bits(v.Float()))), C.ARG_FLAG_FLOAT | C.ARG_FLAG_SIZE_64, nil
+	case reflect.Ptr, reflect.Slice:
+		buf := bufferOf(v)
+		m, err := marshalValue(v, fr.alloc)
+		if err != nil {
+			return nil, 0, err
+		}
+		if m != nil {
+			// Structs are passed by C copy
+			buf = m.buffer
+			fr.copies = append(fr.copies, m)
+		}
+		if len(buf) == 0 {
+			return unsafe.Pointer(v.Pointer()), C.ARG_FLAG_SIZE_PTR, nil
 		}
-		var argp *unsafe.Pointer
-		if count > 0 {
-			argp = &args[0]
+		if fr.san != nil {
+			arg, err = fr.san.protect(index, buf)
+			return arg, C.ARG_FLAG_SIZE_PTR, err
 		}
-		var ret unsafe.Pointer
-		if C.call(handle, argp, &flags[0], C.int(count), &ret) != 0 {
+		return unsafe.Pointer(&buf[0]), C.ARG_FLAG_SIZE_PTR, nil
+	case reflect.Uintptr:
+		return unsafe.Pointer(uintptr(v.Uint())), C.ARG_FLAG_SIZE_PTR, nil
+	case reflect.UnsafePointer:
+		return unsafe.Pointer(v.Pointer()), C.ARG_FLAG_SIZE_PTR, nil
+	default:
+		return nil, 0, fmt.Errorf("can't bind value of type %s", v.Type())
+	}
+}
+
+// retrieveValue converts C result into the Go value of type out
+func retrieveValue(out reflect.Type, ret unsafe.Pointer) (reflect.Value, error) {
+	switch out.Kind() {
+	case reflect.Bool:
+		return reflect.ValueOf(uint8(uintptr(ret)) != 0), nil
+	case reflect.Int:
+		return reflect.ValueOf(int(uintptr(ret))), nil
+	case reflect.Int8:
+		return reflect.ValueOf(int8(uintptr(ret))), nil
+	case reflect.Int16:
+		return reflect.ValueOf(int16(uintptr(ret))), nil
+	case reflect.Int32:
+		return reflect.ValueOf(int32(uintptr(ret))), nil
+	case reflect.Int64:
+		return reflect.ValueOf(int64(uintptr(ret))), nil
+	case reflect.Uint:
+		return reflect.ValueOf(uint(uintptr(ret))), nil
+	case reflect.Uint8:
+		return reflect.ValueOf(uint8(uintptr(ret))), nil
+	case reflect.Uint16:
+		return reflect.ValueOf(uint16(uintptr(ret))), nil
+	case reflect.Uint32:
+		return reflect.ValueOf(uint32(uintptr(ret))), nil
+	case reflect.Uint64:
+		return reflect.ValueOf(uint64(uintptr(ret))), nil
+	case reflect.Float32:
+		return reflect.ValueOf(math.Float32frombits(uint32(uintptr(ret)))), nil
+	case reflect.Float64:
+		return reflect.ValueOf(math.Float64frombits(uint64(uintptr(ret)))), nil
+	case reflect.Ptr:
+		if out.Elem().Kind() == reflect.String && ret != nil {
 			s := C.GoString((*C.char)(ret))
-			C.free(ret)
-			panic(errors.New(s))
-		}
-		if numOut > 0 {
-			var v reflect.Value
-			switch kind {
-			case reflect.Int:
-				v = reflect.ValueOf(int(uintptr(ret)))
-			case reflect.Int8:
-				v = reflect.ValueOf(int8(uintptr(ret)))
-			case reflect.Int16:
-				v = reflect.ValueOf(int16(uintptr(ret)))
-			case reflect.Int32:
-				v = reflect.ValueOf(int32(uintptr(ret)))
-			case reflect.Int64:
-				v = reflect.ValueOf(int64(uintptr(ret)))
-			case reflect.Uint:
-				v = reflect.ValueOf(uint(uintptr(ret)))
-			case reflect.Uint8:
-				v = reflect.ValueOf(uint8(uintptr(ret)))
-			case reflect.Uint16:
-				v = reflect.ValueOf(uint16(uintptr(ret)))
-			case reflect.Uint32:
-				v = reflect.ValueOf(uint32(uintptr(ret)))
-			case reflect.Uint64:
-				v = reflect.ValueOf(uint64(uintptr(ret)))
-			case reflect.Float32:
-				v = reflect.ValueOf(math.Float32frombits(uint32(uintptr(ret))))
-			case reflect.Float64:
-				v = reflect.ValueOf(math.Float64frombits(uint64(uintptr(ret))))
-			case reflect.Ptr:
-				if out.Elem().Kind() == reflect.String && ret != nil {
-					s := C.GoString((*C.char)(ret))
-					v = reflect.ValueOf(&s)
-					break
-				}
-				v = reflect.NewAt(out.Elem(), ret)
-			case reflect.String:
-				s := C.GoString((*C.char)(ret))
-				v = reflect.ValueOf(s)
-			case reflect.Uintptr:
-				v = reflect.ValueOf(uintptr(ret))
-			case reflect.UnsafePointer:
-				v = reflect.ValueOf(ret)
-			default:
-				panic(fmt.Errorf("can't retrieve value of type %s", out))
+			return reflect.ValueOf(&s), nil
+		}
+		if out.Elem().Kind() == reflect.Struct && ret != nil {
+			l, err := layoutOf(out.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			if !l.inplace {
+				// Return a copy
+				v := reflect.New(out.Elem())
+				l.load(ret, v.Elem())
+				return v, nil
 			}
-			return []reflect.Value{v}
 		}
-		return nil
-	}, nil
+		return reflect.NewAt(out.Elem(), ret), nil
+	case reflect.String:
+		s := C.GoString((*C.char)(ret))
+		return reflect.ValueOf(s), nil
+	case reflect.Uintptr:
+		return reflect.ValueOf(uintptr(ret)), nil
+	case reflect.UnsafePointer:
+		return reflect.ValueOf(ret), nil
+	default:
+		return reflect.Value{}, fmt.Errorf("can't retrieve value of type %s", out)
+	}
+}
+
+// release frees memory returned by routine according to its ownership
+func release(routine *Routine, ret unsafe.Pointer) {
+	if ret == nil {
+		return
+	}
+
+	switch routine.Result.Ownership {
+	case OwnedFree:
+		C.free(ret)
+	case OwnedDeallocator:
+		args := []unsafe.Pointer{ret}
+		flags := []C.int{C.ARG_FLAG_SIZE_PTR, 0}
+		var out unsafe.Pointer
+		if C.call(cPointer(routine.dealloc), &args[0], &flags[0], 1, &out) != 0 {
+			C.free(out)
+		}
+	}
+}
+
+// cPointer turns address received from C (code or C memory) into pointer.
+// Conversion is made by C, since the address never refers to Go memory.
+func cPointer(addr uintptr) unsafe.Pointer {
+	return C.c_pointer(C.uintptr_t(addr))
 }
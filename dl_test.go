@@ -19,12 +19,73 @@ func TestParseRoutineDefinition(t *testing.T) {
 		"Invalid type": {
 			src: "xxx print()",
 			dst: nil,
-			err: fmt.Errorf("Unknown type %q", "xxx"),
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "xxx print()",
+				Pos:        0,
+				Msg:        `unknown type "xxx"`,
+			}),
 		},
 		"Error in argument type": {
 			src: "void print(abc)",
 			dst: nil,
-			err: fmt.Errorf("Error in %d argument", 0),
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "void print(abc)",
+				Pos:        11,
+				Msg:        `unknown type "abc"`,
+			}),
+		},
+		"Error in argument": {
+			src: "void print(int x y)",
+			dst: nil,
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "void print(int x y)",
+				Pos:        11,
+				Msg:        "error in 0 argument",
+			}),
+		},
+		"Unknown argument type": {
+			src: "int sum(int a, long b)",
+			dst: nil,
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "int sum(int a, long b)",
+				Pos:        15,
+				Msg:        `unknown type "long"`,
+			}),
+		},
+		"Not a definition": {
+			src: "abs",
+			dst: nil,
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "abs",
+				Msg:        "invalid routine definition",
+			}),
+		},
+		"Text after definition": {
+			src: "int abs(int) x",
+			dst: nil,
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "int abs(int) x",
+				Pos:        12,
+				Msg:        "unexpected text after definition",
+			}),
+		},
+		"Unsupported type modifier": {
+			src: "unsigned int abs(int)",
+			dst: nil,
+			err: fmt.Errorf("ParseRoutineDefinition: %w", &ParseError{
+				Definition: "unsigned int abs(int)",
+				Msg:        "unexpected text before definition",
+			}),
+		},
+		"Trailing semicolon": {
+			src: "bool isset(int64 flags);",
+			dst: &Routine{
+				Name:   "isset",
+				Result: &Arg{Type: reflect.Bool},
+				Args: []*Arg{
+					{Type: reflect.Int64},
+				},
+			},
 		},
 		"Empty func": {
 			src: "void print()",
@@ -33,6 +94,26 @@ func TestParseRoutineDefinition(t *testing.T) {
 				Args: []*Arg{},
 			},
 		},
+		"Unnamed arguments": {
+			src: "int abs(int)",
+			dst: &Routine{
+				Name:   "abs",
+				Result: &Arg{Type: reflect.Int},
+				Args: []*Arg{
+					{Type: reflect.Int},
+				},
+			},
+		},
+		"Pointer result": {
+			src: "void *malloc(uint size)",
+			dst: &Routine{
+				Name:   "malloc",
+				Result: &Arg{Type: reflect.UnsafePointer, Pointer: true},
+				Args: []*Arg{
+					{Type: reflect.Uint},
+				},
+			},
+		},
 		"Complex func": {
 			src: "int size(string disk, int64 *value)",
 			dst: &Routine{
@@ -54,3 +135,49 @@ func TestParseRoutineDefinition(t *testing.T) {
 		})
 	}
 }
+
+func TestRoutineValidate(t *testing.T) {
+	tests := map[string]struct {
+		routine *Routine
+		err     string
+	}{
+		"Valid": {
+			routine: &Routine{Name: "f", Result: &Arg{Type: reflect.Bool}, Args: []*Arg{{Type: reflect.UnsafePointer, Pointer: true}}},
+		},
+		"Empty name": {
+			routine: &Routine{},
+			err:     "routine name is empty",
+		},
+		"Unsupported kind": {
+			routine: &Routine{Name: "f", Args: []*Arg{{Type: reflect.Map}}},
+			err:     "argument 0: unsupported type map",
+		},
+		"Missing argument": {
+			routine: &Routine{Name: "f", Args: []*Arg{nil}},
+			err:     "argument 0: type is not specified",
+		},
+		"String pointer argument": {
+			routine: &Routine{Name: "f", Args: []*Arg{{Type: reflect.String, Pointer: true}}},
+			err:     "argument 0: string can't be passed by pointer",
+		},
+		"Struct type of scalar": {
+			routine: &Routine{Name: "f", Result: &Arg{Type: reflect.Int, Struct: reflect.TypeOf(struct{ A int }{})}},
+			err:     "result: struct type is specified for int",
+		},
+		"Ownership of argument": {
+			routine: &Routine{Name: "f", Args: []*Arg{{Type: reflect.String, Ownership: OwnedFree}}},
+			err:     "argument 0: ownership is applicable to result only",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := test.routine.Validate()
+			if test.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.err)
+		})
+	}
+}
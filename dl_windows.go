@@ -2,16 +2,20 @@
 
 package dl
 
+/*
+#include <stdlib.h>
+*/
 import "C"
 
 import (
 	"errors"
 	"fmt"
-	"github.com/adverax/echo/generic"
 	"math"
 	"reflect"
+	"runtime"
 	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 )
 
@@ -19,10 +23,19 @@ type library struct {
 	sync.Mutex
 	handle   syscall.Handle
 	routines map[string]*Routine
+	pins     pinset // retained arguments
+	handles  HandleScope
+	chain    Chain // interceptors of calls
+	stats    Stats
+	config   config
+	name     string
 }
 
-func (lib *library) Close() error {
+func (lib *library) Close() (err error) {
 	if lib.handle != 0 {
+		defer func() {
+			lib.config.emit(Event{Kind: EventClose, Library: lib.name, Err: err})
+		}()
 		lib.Lock()
 		defer lib.Unlock()
 
@@ -31,33 +44,72 @@ func (lib *library) Close() error {
 			defer mu.Unlock()
 
 			if err := syscall.FreeLibrary(lib.handle); err != nil {
-				return fmt.Errorf("close library^ %w", err)
+				return fmt.Errorf("close library: %w", err)
 			}
 			lib.handle = 0
+			lib.pins.unpin()
+			lib.handles.Release()
 		}
 	}
 
 	return nil
 }
 
-func (lib *library) Define(routine *Routine) error {
+func (lib *library) Define(routine *Routine) (err error) {
+	if routine == nil {
+		return errors.New("library define: routine is nil")
+	}
+	defer func() {
+		lib.config.emit(Event{Kind: EventDefine, Library: lib.name, Symbol: routine.Name, Err: err})
+	}()
 	lib.Lock()
 	defer lib.Unlock()
 
-	lib.routines[routine.Name] = routine
+	if err := routine.Validate(); err != nil {
+		return fmt.Errorf("library define: %w", err)
+	}
+
+	if lib.handle == 0 {
+		return fmt.Errorf("library define: %w", ErrClosed)
+	}
+
 	address, err := syscall.GetProcAddress(syscall.Handle(lib.handle), routine.Name)
 	if err != nil {
-		return fmt.Errorf("library define: %w", err)
+		return fmt.Errorf("library define: %w", &loaderError{msg: err.Error(), kind: ErrSymbolNotFound})
+	}
+
+	var dealloc uintptr
+	if routine.Result != nil && routine.Result.Ownership == OwnedDeallocator {
+		dealloc, err = syscall.GetProcAddress(syscall.Handle(lib.handle), routine.Result.Deallocator)
+		if err != nil {
+			return fmt.Errorf("library define: deallocator: %w", &loaderError{msg: err.Error(), kind: ErrSymbolNotFound})
+		}
 	}
 
+	// Library and routine are changed only when definition succeeds
 	routine.address = address
+	routine.dealloc = dealloc
+	lib.routines[routine.Name] = routine
 
 	return nil
 }
 
 func (lib *library) Symbol(name string, out interface{}) error {
+	return errors.New("symbol: not supported")
+}
+
+func (lib *library) Verify() error {
 	// Not yet implemented
-	return nil
+	return errors.New("Verify: not supported")
+}
+
+func (lib *library) NewHandle(v interface{}) Handle {
+	return lib.handles.NewHandle(v)
+}
+
+func (lib *library) Info() (*Info, error) {
+	// Not yet implemented
+	return nil, errors.New("Info: not supported")
 }
 
 func (lib *library) Call(name string, arguments ...interface{}) (res interface{}, err error) {
@@ -67,26 +119,131 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 		return 0, fmt.Errorf("call: %w", err)
 	}
 
+	count := len(routine.Args)
+	if len(arguments) < count {
+		return false, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+
+	// Convert arguments
+	args := make([]interface{}, count)
+	retain := make([]bool, count)
+	for ii, arg := range routine.Args {
+		argument := arguments[ii]
+		if r, ok := argument.(retained); ok {
+			argument, retain[ii] = r.value, true
+		}
+		argument, err := lib.config.custom(arg, argument)
+		if err != nil {
+			return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, arguments[ii], err))
+		}
+
+		if _, ok := argument.(pointer); ok {
+			// C memory is passed as is
+		} else if arg.Type == reflect.Struct {
+			if _, err := structValue(arg, argument); err != nil {
+				return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, argument, err))
+			}
+		} else {
+			val, err := lib.config.convert(arg, argument)
+			if err != nil {
+				return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, argument, err))
+			}
+			argument = val
+		}
+		args[ii] = argument
+	}
+
+	ctx := CallInfo{Name: name, Routine: routine, Args: args}
+	return lib.chain.Invoke(ctx, func(ctx CallInfo) (interface{}, error) {
+		start := time.Now()
+		res, err := lib.call(routine, ctx.Args, retain)
+		lib.stats.Observe(name, time.Since(start), err)
+		return res, err
+	})
+}
+
+// Stats returns statistics of calls by routine name
+func (lib *library) Stats() map[string]RoutineStats {
+	return lib.stats.Snapshot()
+}
+
+// Use adds interceptors of calls
+func (lib *library) Use(interceptors ...Interceptor) {
+	lib.chain.Use(interceptors...)
+}
+
+func (lib *library) call(routine *Routine, arguments []interface{}, retain []bool) (res interface{}, err error) {
 	// Prepare arguments
 	count := len(routine.Args)
 	args := make([]uintptr, count)
-	if count > 0 {
-		if len(arguments) < count {
-			return false, fmt.Errorf("call: %w", fmt.Errorf("Too few arguments in func %s", routine.Name))
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	var copies []*marshaled
+	var allocs []unsafe.Pointer
+	defer func() {
+		for _, p := range allocs {
+			C.free(p)
 		}
+	}()
+	alloc := func(size uintptr) unsafe.Pointer {
+		p := C.calloc(1, C.size_t(size))
+		allocs = append(allocs, p)
+		return p
+	}
+	if len(arguments) != count {
+		return false, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+	if count > 0 {
 
 		for ii, arg := range routine.Args {
-			val := MakeValue(arg.Type, arg.Pointer)
-			err = generic.ConvertAssign(&val, arguments[ii])
+			argument := arguments[ii]
+			if p, ok := argument.(pointer); ok {
+				// C memory is passed as is
+				args[ii] = uintptr(p.Pointer())
+				continue
+			}
+
+			var v reflect.Value
+			if arg.Type == reflect.Struct {
+				v, err = structValue(arg, argument)
+				if err != nil {
+					return nil, fmt.Errorf("call: %w", newArgumentError(routine, ii, argument, err))
+				}
+			} else {
+				if argument == nil {
+					// NULL
+					continue
+				}
+				v = reflect.ValueOf(argument)
+				if v.Type() == emptyType {
+					v = reflect.ValueOf(v.Interface())
+				}
+			}
+
+			m, err := marshalValue(v, alloc)
 			if err != nil {
-				return nil, fmt.Errorf("call: %w", err)
+				return nil, fmt.Errorf("call: argument %d: %w", ii, err)
+			}
+			if m != nil {
+				// Structs are passed by C copy
+				copies = append(copies, m)
+				args[ii] = uintptr(unsafe.Pointer(&m.buffer[0]))
+				continue
+			}
+
+			if err := checkGoPointers(v); err != nil {
+				return nil, fmt.Errorf("call: argument %d: %w", ii, err)
 			}
-			v := reflect.ValueOf(val)
-			if v.Type() == emptyType {
-				v = reflect.ValueOf(v.Interface())
+			pinValue(&pinner, v)
+			if retain[ii] {
+				lib.pins.pin(v)
 			}
 
 			switch v.Kind() {
+			case reflect.Bool:
+				if v.Bool() {
+					args[ii] = 1
+				}
 			case reflect.String:
 				args[ii] = uintptr(unsafe.Pointer(syscall.StringToUTF16Ptr(v.String())))
 			case reflect.Int:
@@ -170,6 +327,13 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 	default:
 		return 0, fmt.Errorf("call: %w", errors.New("too many arguments"))
 	}
+	// Arguments like *Memory are passed as raw pointers,
+	// finalizers must not release them during the call
+	runtime.KeepAlive(arguments)
+
+	for _, m := range copies {
+		m.unmarshal()
+	}
 
 	if errno != 0 {
 		return 0, fmt.Errorf("call: %w", errno)
@@ -181,10 +345,11 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 	}
 
 	var v reflect.Value
-	vv := MakeValue(routine.Result.Type, routine.Result.Pointer)
-	out := reflect.TypeOf(vv)
+	out := routine.Result.goType()
 
 	switch out.Kind() {
+	case reflect.Bool:
+		v = reflect.ValueOf(uint8(val) != 0)
 	case reflect.Int:
 		v = reflect.ValueOf(int(val))
 	case reflect.Int8:
@@ -215,6 +380,14 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 			v = reflect.ValueOf(&s)
 			break
 		}
+		if out.Elem().Kind() == reflect.Struct && val != 0 {
+			// Return a copy
+			v = reflect.New(out.Elem())
+			if err := Unmarshal(unsafe.Pointer(val), v.Interface()); err != nil {
+				return nil, fmt.Errorf("call: %w", err)
+			}
+			break
+		}
 		v = reflect.NewAt(out.Elem(), unsafe.Pointer(val))
 	case reflect.String:
 		s := C.GoString((*C.char)(unsafe.Pointer(val)))
@@ -227,6 +400,15 @@ func (lib *library) Call(name string, arguments ...interface{}) (res interface{}
 		return v, fmt.Errorf("call: %w", fmt.Errorf("can't retrieve value of type"))
 	}
 
+	if routine.owned() && val != 0 {
+		switch routine.Result.Ownership {
+		case OwnedFree:
+			C.free(unsafe.Pointer(val))
+		case OwnedDeallocator:
+			syscall.Syscall(routine.dealloc, 1, val, 0, 0)
+		}
+	}
+
 	return v.Interface(), nil
 }
 
@@ -234,21 +416,42 @@ func (lib *library) find(name string) (*Routine, error) {
 	lib.Lock()
 	defer lib.Unlock()
 
+	if lib.handle == 0 {
+		return nil, ErrClosed
+	}
 	if routine, ok := lib.routines[name]; ok {
 		return routine, nil
 	}
 
-	return nil, fmt.Errorf("call: %w", fmt.Errorf("Function %q not found", name))
+	return nil, fmt.Errorf("find: %w: %s", ErrSymbolNotFound, name)
 }
 
-func Open(name string, flag int) (Library, error) {
+func Open(name string, flag int, options ...Option) (Library, error) {
+	cfg := newConfig(options)
+	if cfg.sanitize {
+		return nil, errors.New("open library: sanitizer is not supported")
+	}
+
 	handle, err := syscall.LoadLibrary(name)
+	cfg.emit(Event{Kind: EventOpen, Library: name, Flags: flag, Err: err})
 	if err != nil {
-		return nil, fmt.Errorf("open library: %w", err)
+		kind := ErrIncompatibleLibrary
+		switch err {
+		case syscall.ERROR_FILE_NOT_FOUND, syscall.ERROR_PATH_NOT_FOUND, syscall.ERROR_MOD_NOT_FOUND:
+			kind = ErrLibraryNotFound
+		}
+		return nil, fmt.Errorf("open library: %w", &loaderError{msg: err.Error(), kind: kind})
 	}
 
-	return &library{
+	lib := &library{
 		handle:   handle,
 		routines: make(map[string]*Routine),
-	}, nil
+		config:   cfg,
+		name:     name,
+	}
+	if cfg.expvar != "" {
+		lib.stats.Publish(cfg.expvar)
+	}
+
+	return lib, nil
 }
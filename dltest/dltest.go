@@ -0,0 +1,451 @@
+// Package dltest provides in-memory implementation of dl.Library
+// for unit tests of code, which depends on shared libraries.
+package dltest
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/adverax/dl"
+)
+
+// Call is a record of a single call
+type Call struct {
+	Name   string
+	Args   []interface{}
+	Result interface{}
+	Err    error
+}
+
+// fault is injected into calls of the routine
+type fault struct {
+	err   error
+	delay time.Duration
+}
+
+// Library is an in-memory dl.Library. Go functions and globals are
+// registered by name, routines passed to Define are enforced like
+// real libraries do: arguments are counted and converted according
+// to the definition (and the conversion policy) before the function
+// is called. Values are passed to Go functions without loss only.
+type Library struct {
+	mu         sync.Mutex
+	funcs      map[string]reflect.Value
+	globals    map[string]interface{}
+	routines   map[string]*dl.Routine
+	faults     map[string]fault
+	calls      []Call
+	handles    dl.HandleScope
+	chain      dl.Chain
+	stats      dl.Stats
+	conversion dl.Conversion
+	converters map[reflect.Type]dl.Converter
+	closed     bool
+}
+
+var _ dl.Library = (*Library)(nil)
+
+// New creates empty library
+func New() *Library {
+	return &Library{
+		funcs:      make(map[string]reflect.Value),
+		globals:    make(map[string]interface{}),
+		routines:   make(map[string]*dl.Routine),
+		faults:     make(map[string]fault),
+		converters: make(map[reflect.Type]dl.Converter),
+	}
+}
+
+// Func registers Go function under the name
+func (lib *Library) Func(name string, fn interface{}) *Library {
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func {
+		panic(fmt.Sprintf("dltest: %s is %T, not a function", name, fn))
+	}
+	if v.Type().NumOut() > 1 {
+		panic(fmt.Sprintf("dltest: %s returns %d values, not 0 or 1", name, v.Type().NumOut()))
+	}
+
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.funcs[name] = v
+	return lib
+}
+
+// Global registers variable under the name
+func (lib *Library) Global(name string, v interface{}) *Library {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.globals[name] = v
+	return lib
+}
+
+// Conversion sets policy of argument conversion (like dl.WithConversion)
+func (lib *Library) Conversion(policy dl.Conversion) *Library {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.conversion = policy
+	return lib
+}
+
+// Converter registers converter of arguments of the same Go type
+// as sample (like dl.WithConverter)
+func (lib *Library) Converter(sample interface{}, converter dl.Converter) *Library {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.converters[reflect.TypeOf(sample)] = converter
+	return lib
+}
+
+// Fail makes calls of the routine fail with the error (nil removes the fault)
+func (lib *Library) Fail(name string, err error) *Library {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	f := lib.faults[name]
+	f.err = err
+	lib.faults[name] = f
+	return lib
+}
+
+// Delay makes calls of the routine sleep before returning
+func (lib *Library) Delay(name string, d time.Duration) *Library {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	f := lib.faults[name]
+	f.delay = d
+	lib.faults[name] = f
+	return lib
+}
+
+// Calls returns records of all calls in order
+func (lib *Library) Calls() []Call {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	return append([]Call(nil), lib.calls...)
+}
+
+// Reset forgets recorded calls
+func (lib *Library) Reset() {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	lib.calls = nil
+}
+
+func (lib *Library) Close() error {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if !lib.closed {
+		lib.closed = true
+		lib.handles.Release()
+	}
+	return nil
+}
+
+func (lib *Library) Define(routine *dl.Routine) error {
+	if routine == nil {
+		return errors.New("define: routine is nil")
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+
+	if lib.closed {
+		return fmt.Errorf("define %s: %w", routine.Name, dl.ErrClosed)
+	}
+	if err := routine.Validate(); err != nil {
+		return fmt.Errorf("define %s: %w", routine.Name, err)
+	}
+	fn, ok := lib.funcs[routine.Name]
+	if !ok {
+		return fmt.Errorf("define %s: %w", routine.Name, dl.ErrSymbolNotFound)
+	}
+
+	typ := fn.Type()
+	if typ.NumIn() != len(routine.Args) && !typ.IsVariadic() {
+		return fmt.Errorf("define %s: function takes %d arguments, definition has %d", routine.Name, typ.NumIn(), len(routine.Args))
+	}
+	if (routine.Result != nil) != (typ.NumOut() == 1) {
+		return fmt.Errorf("define %s: results of function and definition differ", routine.Name)
+	}
+
+	lib.routines[routine.Name] = routine
+	return nil
+}
+
+func (lib *Library) Call(name string, arguments ...interface{}) (interface{}, error) {
+	lib.mu.Lock()
+	routine, ok := lib.routines[name]
+	fn := lib.funcs[name]
+	closed := lib.closed
+	policy := lib.conversion
+	converters := lib.converters
+	lib.mu.Unlock()
+
+	if closed {
+		return nil, fmt.Errorf("call: %w", dl.ErrClosed)
+	}
+	if !ok {
+		return nil, fmt.Errorf("call: find: %w: %s", dl.ErrSymbolNotFound, name)
+	}
+	if len(arguments) != len(routine.Args) {
+		return nil, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+
+	args := make([]interface{}, len(routine.Args))
+	for ii, arg := range routine.Args {
+		argument := arguments[ii]
+		if converter, ok := converters[reflect.TypeOf(argument)]; ok {
+			var err error
+			if argument, err = converter(argument, arg); err != nil {
+				return nil, fmt.Errorf("call: %w", argumentError(routine, ii, arguments[ii], err))
+			}
+		}
+		v, err := convertArg(policy, arg, argument)
+		if err != nil {
+			return nil, fmt.Errorf("call: %w", argumentError(routine, ii, argument, err))
+		}
+		if v.IsValid() {
+			args[ii] = v.Interface()
+		}
+	}
+
+	ctx := dl.CallInfo{Name: name, Routine: routine, Args: args}
+	return lib.chain.Invoke(ctx, func(ctx dl.CallInfo) (interface{}, error) {
+		return lib.call(routine, fn, ctx.Args, arguments)
+	})
+}
+
+// call invokes function with converted arguments
+func (lib *Library) call(routine *dl.Routine, fn reflect.Value, args []interface{}, arguments []interface{}) (interface{}, error) {
+	if len(args) != len(routine.Args) {
+		return nil, fmt.Errorf("call: %w", argumentCount(routine, len(args)))
+	}
+	in := make([]reflect.Value, len(routine.Args))
+	for ii := range routine.Args {
+		var err error
+		in[ii], err = convertTo(reflect.ValueOf(args[ii]), paramType(fn.Type(), ii))
+		if err != nil {
+			return nil, fmt.Errorf("call: %w", argumentError(routine, ii, args[ii], err))
+		}
+	}
+
+	res, err := lib.invoke(routine.Name, fn, in, arguments)
+	if err != nil || routine.Result == nil {
+		return nil, err
+	}
+
+	typ := reflect.TypeOf(dl.MakeValue(routine.Result.Type, routine.Result.Pointer))
+	if routine.Result.Type == reflect.Struct {
+		return res.Interface(), nil
+	}
+	v, err := convertTo(res, typ)
+	if err != nil {
+		return nil, fmt.Errorf("call: result: %w", err)
+	}
+	return v.Interface(), nil
+}
+
+// invoke calls function with injected faults and records the call
+func (lib *Library) invoke(name string, fn reflect.Value, in []reflect.Value, args []interface{}) (reflect.Value, error) {
+	lib.mu.Lock()
+	f := lib.faults[name]
+	lib.mu.Unlock()
+
+	start := time.Now()
+	if f.delay != 0 {
+		time.Sleep(f.delay)
+	}
+
+	rec := Call{Name: name, Args: args, Err: f.err}
+	var res reflect.Value
+	if f.err == nil {
+		out := fn.Call(in)
+		if len(out) != 0 {
+			res = out[0]
+			rec.Result = res.Interface()
+		}
+	}
+
+	lib.mu.Lock()
+	lib.calls = append(lib.calls, rec)
+	lib.mu.Unlock()
+	lib.stats.Observe(name, time.Since(start), f.err)
+
+	if f.err != nil {
+		return res, fmt.Errorf("call: %w", f.err)
+	}
+	return res, nil
+}
+
+func (lib *Library) Symbol(name string, out interface{}) error {
+	val := reflect.ValueOf(out)
+	if !val.IsValid() || val.Kind() != reflect.Ptr {
+		return fmt.Errorf("out must be a pointer, not %T", out)
+	}
+	if val.IsNil() {
+		return errors.New("out can't be nil")
+	}
+
+	lib.mu.Lock()
+	fn, isFunc := lib.funcs[name]
+	global, isGlobal := lib.globals[name]
+	lib.mu.Unlock()
+
+	elem := val.Elem()
+	switch {
+	case isFunc && elem.Kind() == reflect.Func:
+		typ := elem.Type()
+		if typ.NumIn() != fn.Type().NumIn() || typ.NumOut() != fn.Type().NumOut() {
+			return fmt.Errorf("symbol: %s is %s, not %s", name, fn.Type(), typ)
+		}
+		elem.Set(reflect.MakeFunc(typ, func(in []reflect.Value) []reflect.Value {
+			args := make([]interface{}, len(in))
+			for ii, v := range in {
+				args[ii] = v.Interface()
+			}
+			ctx := dl.CallInfo{Name: name, Args: args}
+			res, err := lib.chain.Invoke(ctx, func(ctx dl.CallInfo) (interface{}, error) {
+				in := make([]reflect.Value, len(ctx.Args))
+				for ii, arg := range ctx.Args {
+					var err error
+					if in[ii], err = convertTo(reflect.ValueOf(arg), paramType(fn.Type(), ii)); err != nil {
+						return nil, err
+					}
+				}
+				res, err := lib.invoke(name, fn, in, ctx.Args)
+				if err != nil || !res.IsValid() {
+					return nil, err
+				}
+				return res.Interface(), nil
+			})
+			if err != nil {
+				// Functions retrieved from real libraries panic as well
+				panic(err)
+			}
+			if typ.NumOut() == 0 {
+				return nil
+			}
+			v, err := convertTo(reflect.ValueOf(res), typ.Out(0))
+			if err != nil {
+				panic(err)
+			}
+			return []reflect.Value{v}
+		}))
+	case isGlobal:
+		v, err := convertTo(reflect.ValueOf(global), elem.Type())
+		if err != nil {
+			return fmt.Errorf("symbol: %s: %w", name, err)
+		}
+		elem.Set(v)
+	default:
+		return fmt.Errorf("symbol: %s: %w", name, dl.ErrSymbolNotFound)
+	}
+
+	return nil
+}
+
+// Verify always succeeds, since definitions are checked by Define
+func (lib *Library) Verify() error {
+	return nil
+}
+
+func (lib *Library) Info() (*dl.Info, error) {
+	return &dl.Info{Path: "dltest"}, nil
+}
+
+func (lib *Library) NewHandle(v interface{}) dl.Handle {
+	return lib.handles.NewHandle(v)
+}
+
+func (lib *Library) Use(interceptors ...dl.Interceptor) {
+	lib.chain.Use(interceptors...)
+}
+
+func (lib *Library) Stats() map[string]dl.RoutineStats {
+	return lib.stats.Snapshot()
+}
+
+// argumentCount reports wrong number of arguments like real library does
+func argumentCount(routine *dl.Routine, got int) *dl.ArgumentError {
+	return &dl.ArgumentError{
+		Routine: routine.Name,
+		Index:   -1,
+		Want:    fmt.Sprintf("%d arguments", len(routine.Args)),
+		Got:     fmt.Sprintf("%d", got),
+	}
+}
+
+// argumentError reports argument, which can't be converted
+func argumentError(routine *dl.Routine, index int, argument interface{}, err error) *dl.ArgumentError {
+	arg := routine.Args[index]
+	want := arg.Type.String()
+	if arg.Pointer {
+		want += " *"
+	}
+	return &dl.ArgumentError{
+		Routine: routine.Name,
+		Index:   index,
+		Want:    want,
+		Got:     fmt.Sprintf("%T", argument),
+		Err:     err,
+	}
+}
+
+// convertArg converts argument the same way as Call of real library does
+func convertArg(policy dl.Conversion, arg *dl.Arg, argument interface{}) (reflect.Value, error) {
+	if _, ok := argument.(interface{ Pointer() unsafe.Pointer }); ok || arg.Type == reflect.Struct {
+		// C memory and structs are passed as is
+		return reflect.ValueOf(argument), nil
+	}
+	if policy == dl.ConvertLenient && (arg.Pointer || arg.Type == reflect.UnsafePointer) {
+		// Pointers are passed as is
+		return reflect.ValueOf(argument), nil
+	}
+
+	val, err := dl.Convert(policy, arg, argument)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return reflect.ValueOf(val), nil
+}
+
+// convertTo converts value into type of parameter of Go function.
+// Numbers are converted only when they are represented exactly.
+func convertTo(v reflect.Value, typ reflect.Type) (reflect.Value, error) {
+	if !v.IsValid() {
+		return reflect.Zero(typ), nil
+	}
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Type().AssignableTo(typ) {
+		return v, nil
+	}
+	if v.Kind() == typ.Kind() && v.Type().ConvertibleTo(typ) {
+		// Named type of the same kind
+		return v.Convert(typ), nil
+	}
+	if isNumeric(v.Kind()) && isNumeric(typ.Kind()) {
+		val, err := dl.Convert(dl.ConvertChecked, &dl.Arg{Type: typ.Kind()}, v.Interface())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(val).Convert(typ), nil
+	}
+	return reflect.Value{}, fmt.Errorf("can't convert %s to %s", v.Type(), typ)
+}
+
+func isNumeric(kind reflect.Kind) bool {
+	return kind >= reflect.Int && kind <= reflect.Float64
+}
+
+// paramType returns type of argument of the function
+func paramType(typ reflect.Type, index int) reflect.Type {
+	if typ.IsVariadic() && index >= typ.NumIn()-1 {
+		return typ.In(typ.NumIn() - 1).Elem()
+	}
+	return typ.In(index)
+}
@@ -0,0 +1,137 @@
+package dltest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/adverax/dl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLibrary(t *testing.T) {
+	lib := New().
+		Func("abs", func(v int32) int32 {
+			if v < 0 {
+				return -v
+			}
+			return v
+		}).
+		Func("reset", func() {}).
+		Global("version", int32(3))
+	defer lib.Close()
+
+	err := lib.Define(&dl.Routine{
+		Name:   "abs",
+		Result: &dl.Arg{Type: reflect.Int32},
+		Args:   []*dl.Arg{{Type: reflect.Int32}},
+	})
+	require.NoError(t, err)
+
+	// Arguments are converted according to the definition
+	res, err := lib.Call("abs", -5)
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), res)
+
+	_, err = lib.Call("abs")
+	assert.Error(t, err)
+	_, err = lib.Call("reset")
+	assert.Error(t, err)
+
+	assert.Error(t, lib.Define(&dl.Routine{Name: "abs"}))
+	assert.ErrorIs(t, lib.Define(&dl.Routine{Name: "missing"}), dl.ErrSymbolNotFound)
+	assert.Error(t, lib.Define(nil))
+	var argErr *dl.ArgumentError
+	_, err = lib.Call("abs", "x")
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, 0, argErr.Index)
+
+	var version int
+	require.NoError(t, lib.Symbol("version", &version))
+	assert.Equal(t, 3, version)
+
+	var abs func(int) int
+	require.NoError(t, lib.Symbol("abs", &abs))
+	assert.Equal(t, 7, abs(-7))
+
+	calls := lib.Calls()
+	require.Len(t, calls, 2)
+	assert.Equal(t, Call{Name: "abs", Args: []interface{}{-5}, Result: int32(5)}, calls[0])
+	assert.Equal(t, int32(7), calls[1].Result)
+}
+
+func TestFaults(t *testing.T) {
+	failure := errors.New("device busy")
+	lib := New().Func("open", func() int32 { return 1 })
+	require.NoError(t, lib.Define(&dl.Routine{Name: "open", Result: &dl.Arg{Type: reflect.Int32}}))
+
+	lib.Fail("open", failure).Delay("open", 10*time.Millisecond)
+	start := time.Now()
+	_, err := lib.Call("open")
+	assert.ErrorIs(t, err, failure)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+
+	var open func() int32
+	require.NoError(t, lib.Symbol("open", &open))
+	assert.Panics(t, func() { open() })
+
+	lib.Fail("open", nil)
+	res, err := lib.Call("open")
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), res)
+	assert.Len(t, lib.Calls(), 3)
+	stats := lib.Stats()["open"]
+	assert.Equal(t, uint64(3), stats.Calls)
+	assert.Equal(t, uint64(2), stats.Errors)
+	assert.GreaterOrEqual(t, stats.Max, 10*time.Millisecond)
+
+	h := lib.NewHandle("state")
+	require.NoError(t, lib.Close())
+	_, err = h.Value()
+	assert.ErrorIs(t, err, dl.ErrStaleHandle)
+	_, err = lib.Call("open")
+	assert.ErrorIs(t, err, dl.ErrClosed)
+}
+
+func TestConversion(t *testing.T) {
+	lib := New().
+		Func("id", func(v float64) float64 { return v }).
+		Func("half", func() float64 { return 1.5 }).
+		Func("len", func(s string) int { return len(s) }).
+		Conversion(dl.ConvertStrict).
+		Converter(time.Duration(0), func(v interface{}, arg *dl.Arg) (interface{}, error) {
+			return int32(v.(time.Duration) / time.Second), nil
+		})
+	defer lib.Close()
+
+	require.NoError(t, lib.Define(&dl.Routine{Name: "id", Result: &dl.Arg{Type: reflect.Int32}, Args: []*dl.Arg{{Type: reflect.Int32}}}))
+	require.NoError(t, lib.Define(&dl.Routine{Name: "half", Result: &dl.Arg{Type: reflect.Int32}}))
+	require.NoError(t, lib.Define(&dl.Routine{Name: "len", Result: &dl.Arg{Type: reflect.Int32}, Args: []*dl.Arg{{Type: reflect.Int32}}}))
+
+	res, err := lib.Call("id", int32(3))
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), res)
+
+	// Policy of the library is applied
+	var argErr *dl.ArgumentError
+	_, err = lib.Call("id", 3)
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, 0, argErr.Index)
+
+	res, err = lib.Call("id", 2*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), res)
+
+	// Values aren't truncated or turned into runes
+	_, err = lib.Call("half")
+	assert.Error(t, err)
+	_, err = lib.Call("len", int32(65))
+	assert.Error(t, err)
+
+	var id func(int64) int8
+	require.NoError(t, lib.Symbol("id", &id))
+	assert.Equal(t, int8(7), id(7))
+	assert.Panics(t, func() { id(1 << 54) })
+}
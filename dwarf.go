@@ -0,0 +1,621 @@
+package dl
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// Directory of separate debug files
+var debugDir = "/usr/lib/debug"
+
+// Mismatch describes difference between routine definition and debug info
+type Mismatch struct {
+	Routine string `json:"routine"`
+	Index   int    `json:"index"` // Index of argument, -1 for result and routine itself
+	Want    string `json:"want"`  // Type declared by debug info
+	Got     string `json:"got"`   // Type declared by definition
+	Message string `json:"message,omitempty"`
+}
+
+func (m Mismatch) String() string {
+	if m.Want == "" || m.Got == "" {
+		return fmt.Sprintf("%s: %s", m.Routine, m.Message)
+	}
+
+	where := "result"
+	if m.Index >= 0 {
+		where = fmt.Sprintf("argument %d", m.Index)
+	}
+	if m.Message == "" {
+		return fmt.Sprintf("%s: %s: want %s, got %s", m.Routine, where, m.Want, m.Got)
+	}
+	return fmt.Sprintf("%s: %s: want %s, got %s (%s)", m.Routine, where, m.Want, m.Got, m.Message)
+}
+
+// VerifyError lists all mismatches found by verification
+type VerifyError struct {
+	Mismatches []Mismatch
+}
+
+func (e *VerifyError) Error() string {
+	lines := make([]string, len(e.Mismatches))
+	for ii, m := range e.Mismatches {
+		lines[ii] = m.String()
+	}
+	return "routines don't match debug info:\n\t" + strings.Join(lines, "\n\t")
+}
+
+// VerifyRoutines compares definitions of routines against DWARF debug info
+// of the library file (or its separate debug file found by build-id or
+// debug link). All mismatches are returned, nothing is called.
+func VerifyRoutines(path string, routines ...*Routine) ([]Mismatch, error) {
+	info, err := loadDebugInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+
+	var res []Mismatch
+	for _, routine := range routines {
+		res = append(res, info.verify(routine)...)
+	}
+
+	return res, nil
+}
+
+// debugInfo holds prototypes of external functions declared by DWARF
+type debugInfo struct {
+	data  *dwarf.Data
+	funcs map[string]*cfunc
+}
+
+// cfunc is a prototype of C function
+type cfunc struct {
+	name     string
+	result   *ctype // nil for void
+	params   []*ctype
+	names    []string // names of parameters
+	variadic bool
+}
+
+// ctype is a simplified C type
+type ctype struct {
+	kind     ctypeKind
+	name     string
+	size     int64
+	signed   bool
+	readonly bool      // qualified by const
+	elem     *ctype    // pointee
+	members  []*member // struct and union members
+}
+
+type member struct {
+	name      string
+	offset    int64
+	bitOffset int64
+	bitSize   int64
+	typ       *ctype
+}
+
+type ctypeKind int
+
+const (
+	ctypeVoid ctypeKind = iota
+	ctypeInt
+	ctypeUint
+	ctypeFloat
+	ctypeBool
+	ctypeChar
+	ctypePointer
+	ctypeStruct
+	ctypeUnion
+	ctypeArray
+	ctypeFunc
+	ctypeOther
+)
+
+func (t *ctype) String() string {
+	if t == nil {
+		return "void"
+	}
+
+	switch t.kind {
+	case ctypePointer:
+		return t.elem.String() + " *"
+	case ctypeStruct:
+		return "struct " + t.name
+	case ctypeUnion:
+		return "union " + t.name
+	default:
+		if t.name == "" {
+			return "?"
+		}
+		if t.readonly {
+			return "const " + t.name
+		}
+		return t.name
+	}
+}
+
+// loadDebugInfo reads DWARF of ELF file or its separate debug file
+func loadDebugInfo(path string) (*debugInfo, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := dwarfOf(f)
+	if err != nil || !hasDebugInfo(f) {
+		data = nil
+		for _, name := range debugFiles(path, f) {
+			df, err := elf.Open(name)
+			if err != nil {
+				continue
+			}
+			data, err = dwarfOf(df)
+			df.Close()
+			if err == nil {
+				break
+			}
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s: no debug info", path)
+	}
+
+	info := &debugInfo{
+		data:  data,
+		funcs: make(map[string]*cfunc),
+	}
+	if err := info.load(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return info, nil
+}
+
+func dwarfOf(f *elf.File) (*dwarf.Data, error) {
+	if !hasDebugInfo(f) {
+		return nil, errors.New("no debug info")
+	}
+	return f.DWARF()
+}
+
+func hasDebugInfo(f *elf.File) bool {
+	s := f.Section(".debug_info")
+	return s != nil && s.Type != elf.SHT_NOBITS
+}
+
+// BuildID returns GNU build-id of ELF file as hex string (empty, if absent)
+func BuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("build id: %w", err)
+	}
+	defer f.Close()
+
+	return buildID(f), nil
+}
+
+func buildID(f *elf.File) string {
+	s := f.Section(".note.gnu.build-id")
+	if s == nil {
+		return ""
+	}
+	data, err := s.Data()
+	if err != nil || len(data) < 16 {
+		return ""
+	}
+
+	// Note: namesz, descsz, type, name ("GNU\0"), desc
+	order := f.ByteOrder
+	namesz := order.Uint32(data[0:4])
+	descsz := order.Uint32(data[4:8])
+	start := 12 + (namesz+3)&^3
+	if order.Uint32(data[8:12]) != 3 || int(start+descsz) > len(data) {
+		return ""
+	}
+
+	return hex.EncodeToString(data[start : start+descsz])
+}
+
+// debugFiles returns candidates of the separate debug file
+func debugFiles(path string, f *elf.File) []string {
+	var res []string
+	if id := buildID(f); len(id) > 2 {
+		res = append(res, filepath.Join(debugDir, ".build-id", id[:2], id[2:]+".debug"))
+	}
+
+	if s := f.Section(".gnu_debuglink"); s != nil {
+		if data, err := s.Data(); err == nil {
+			name := string(data)
+			if i := strings.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+			if name != "" {
+				dir := filepath.Dir(path)
+				if real, err := filepath.EvalSymlinks(path); err == nil {
+					dir = filepath.Dir(real)
+				}
+				res = append(res,
+					filepath.Join(dir, name),
+					filepath.Join(dir, ".debug", name),
+					filepath.Join(debugDir, dir, name),
+				)
+			}
+		}
+	}
+
+	var exists []string
+	for _, name := range res {
+		if _, err := os.Stat(name); err == nil {
+			exists = append(exists, name)
+		}
+	}
+	return exists
+}
+
+func (info *debugInfo) load() error {
+	// Types are shared by all functions, so the same struct is converted once
+	seen := make(map[dwarf.Type]*ctype)
+	r := info.data.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			return nil
+		}
+		if e.Tag != dwarf.TagSubprogram {
+			continue
+		}
+
+		fn, err := info.subprogram(r, e, seen)
+		if err != nil {
+			return err
+		}
+		if fn != nil {
+			if _, ok := info.funcs[fn.name]; !ok {
+				info.funcs[fn.name] = fn
+			}
+		}
+	}
+}
+
+// subprogram reads prototype of external function
+func (info *debugInfo) subprogram(r *dwarf.Reader, e *dwarf.Entry, seen map[dwarf.Type]*ctype) (*cfunc, error) {
+	name, _ := e.Val(dwarf.AttrName).(string)
+	external, _ := e.Val(dwarf.AttrExternal).(bool)
+	declaration, _ := e.Val(dwarf.AttrDeclaration).(bool)
+	if !external || declaration || name == "" {
+		if e.Children {
+			r.SkipChildren()
+		}
+		return nil, nil
+	}
+
+	fn := &cfunc{name: name}
+	if off, ok := e.Val(dwarf.AttrType).(dwarf.Offset); ok {
+		fn.result = info.typeAt(off, seen)
+	}
+
+	if !e.Children {
+		return fn, nil
+	}
+
+	for {
+		child, err := r.Next()
+		if err != nil {
+			return nil, err
+		}
+		if child == nil || child.Tag == 0 {
+			break
+		}
+		switch child.Tag {
+		case dwarf.TagFormalParameter:
+			off, _ := child.Val(dwarf.AttrType).(dwarf.Offset)
+			name, _ := child.Val(dwarf.AttrName).(string)
+			fn.params = append(fn.params, info.typeAt(off, seen))
+			fn.names = append(fn.names, name)
+		case dwarf.TagUnspecifiedParameters:
+			fn.variadic = true
+		}
+		if child.Children {
+			r.SkipChildren()
+		}
+	}
+
+	return fn, nil
+}
+
+// typeAt converts DWARF type into simplified C type
+func (info *debugInfo) typeAt(off dwarf.Offset, seen map[dwarf.Type]*ctype) *ctype {
+	typ, err := info.data.Type(off)
+	if err != nil {
+		return &ctype{kind: ctypeOther, name: "?"}
+	}
+
+	return convertType(typ, seen)
+}
+
+func convertType(typ dwarf.Type, seen map[dwarf.Type]*ctype) *ctype {
+	if t, ok := seen[typ]; ok {
+		return t
+	}
+
+	switch t := typ.(type) {
+	case *dwarf.TypedefType:
+		return convertType(t.Type, seen)
+	case *dwarf.QualType:
+		res := convertType(t.Type, seen)
+		switch res.kind {
+		case ctypeInt, ctypeUint, ctypeChar, ctypeFloat, ctypeBool:
+			if t.Qual == "const" {
+				c := *res
+				c.readonly = true
+				return &c
+			}
+		}
+		return res
+	case *dwarf.VoidType:
+		return &ctype{kind: ctypeVoid, name: "void"}
+	case *dwarf.IntType:
+		return &ctype{kind: ctypeInt, name: t.Name, size: t.ByteSize, signed: true}
+	case *dwarf.UintType:
+		return &ctype{kind: ctypeUint, name: t.Name, size: t.ByteSize}
+	case *dwarf.CharType:
+		return &ctype{kind: ctypeChar, name: t.Name, size: t.ByteSize, signed: true}
+	case *dwarf.UcharType:
+		return &ctype{kind: ctypeChar, name: t.Name, size: t.ByteSize}
+	case *dwarf.FloatType:
+		return &ctype{kind: ctypeFloat, name: t.Name, size: t.ByteSize}
+	case *dwarf.BoolType:
+		return &ctype{kind: ctypeBool, name: t.Name, size: t.ByteSize}
+	case *dwarf.EnumType:
+		name := "enum " + t.EnumName
+		for _, v := range t.Val {
+			if v.Val < 0 {
+				return &ctype{kind: ctypeInt, name: name, size: t.ByteSize, signed: true}
+			}
+		}
+		return &ctype{kind: ctypeUint, name: name, size: t.ByteSize}
+	case *dwarf.PtrType:
+		res := &ctype{kind: ctypePointer, size: t.ByteSize}
+		seen[typ] = res
+		if _, ok := t.Type.(*dwarf.VoidType); ok || t.Type == nil {
+			res.elem = &ctype{kind: ctypeVoid, name: "void"}
+		} else {
+			res.elem = convertType(t.Type, seen)
+		}
+		return res
+	case *dwarf.StructType:
+		res := &ctype{kind: ctypeStruct, name: t.StructName, size: t.ByteSize}
+		if t.Kind == "union" {
+			res.kind = ctypeUnion
+		}
+		seen[typ] = res
+		for _, f := range t.Field {
+			m := &member{
+				name:    f.Name,
+				offset:  f.ByteOffset,
+				bitSize: f.BitSize,
+				typ:     convertType(f.Type, seen),
+			}
+			if f.BitSize != 0 {
+				m.bitOffset = f.DataBitOffset
+			}
+			res.members = append(res.members, m)
+		}
+		return res
+	case *dwarf.ArrayType:
+		return &ctype{kind: ctypeArray, name: t.String(), size: t.ByteSize, elem: convertType(t.Type, seen)}
+	case *dwarf.FuncType:
+		return &ctype{kind: ctypeFunc, name: t.String()}
+	default:
+		return &ctype{kind: ctypeOther, name: typ.String(), size: typ.Size()}
+	}
+}
+
+// verify compares routine against prototype declared by debug info
+func (info *debugInfo) verify(routine *Routine) []Mismatch {
+	fn, ok := info.funcs[routine.Name]
+	if !ok {
+		return []Mismatch{{
+			Routine: routine.Name,
+			Index:   -1,
+			Message: "no debug info for routine",
+		}}
+	}
+
+	var res []Mismatch
+	if len(routine.Args) != len(fn.params) && !(fn.variadic && len(routine.Args) > len(fn.params)) {
+		res = append(res, Mismatch{
+			Routine: routine.Name,
+			Index:   -1,
+			Message: fmt.Sprintf("want %d arguments (%s), got %d", len(fn.params), fn, len(routine.Args)),
+		})
+	}
+
+	for ii, arg := range routine.Args {
+		if ii >= len(fn.params) {
+			break
+		}
+		if msg := matchArg(arg, fn.params[ii]); msg != "" {
+			res = append(res, Mismatch{
+				Routine: routine.Name,
+				Index:   ii,
+				Want:    fn.params[ii].String(),
+				Got:     formatArg(arg),
+				Message: msg,
+			})
+		}
+	}
+
+	result := fn.result
+	if result != nil && result.kind == ctypeVoid {
+		result = nil
+	}
+	switch {
+	case routine.Result == nil && result != nil:
+		res = append(res, Mismatch{Routine: routine.Name, Index: -1, Want: result.String(), Got: "void"})
+	case routine.Result != nil && result == nil:
+		res = append(res, Mismatch{Routine: routine.Name, Index: -1, Want: "void", Got: formatArg(routine.Result)})
+	case routine.Result != nil:
+		if msg := matchArg(routine.Result, result); msg != "" {
+			res = append(res, Mismatch{
+				Routine: routine.Name,
+				Index:   -1,
+				Want:    result.String(),
+				Got:     formatArg(routine.Result),
+				Message: msg,
+			})
+		}
+	}
+
+	return res
+}
+
+func (fn *cfunc) String() string {
+	params := make([]string, len(fn.params))
+	for ii, p := range fn.params {
+		params[ii] = p.String()
+	}
+	if fn.variadic {
+		params = append(params, "...")
+	}
+	return fmt.Sprintf("%s %s(%s)", fn.result, fn.name, strings.Join(params, ", "))
+}
+
+// matchArg returns description of mismatch between Go argument and C type
+func matchArg(arg *Arg, t *ctype) string {
+	if arg.Pointer {
+		if t.kind != ctypePointer {
+			return "pointer expected"
+		}
+		if arg.Type == reflect.Struct {
+			return matchStruct(arg.Struct, t.elem)
+		}
+		if arg.Type == reflect.UnsafePointer || t.elem.kind == ctypeVoid {
+			return ""
+		}
+		return matchScalar(arg.Type, t.elem)
+	}
+
+	return matchScalar(arg.Type, t)
+}
+
+func matchScalar(kind reflect.Kind, t *ctype) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if t.kind != ctypeInt && t.kind != ctypeUint && t.kind != ctypeChar && t.kind != ctypeBool {
+			return "integer expected"
+		}
+		size := kindSize(kind)
+		if size != t.size {
+			return fmt.Sprintf("size %d expected", t.size)
+		}
+		signed := kind >= reflect.Int && kind <= reflect.Int64
+		if t.kind == ctypeInt && !signed || t.kind == ctypeUint && signed {
+			return "signedness differs"
+		}
+	case reflect.Bool:
+		if t.kind != ctypeBool && t.kind != ctypeChar && t.kind != ctypeInt && t.kind != ctypeUint || t.size != 1 {
+			return "bool expected"
+		}
+	case reflect.Float32, reflect.Float64:
+		if t.kind != ctypeFloat || t.size != kindSize(kind) {
+			return "floating point expected"
+		}
+	case reflect.String:
+		if t.kind != ctypePointer || t.elem.kind != ctypeChar {
+			return "char * expected"
+		}
+	case reflect.Uintptr:
+		if t.kind != ctypePointer && !(t.kind == ctypeUint && t.size == 8) {
+			return "pointer expected"
+		}
+	case reflect.UnsafePointer:
+		if t.kind != ctypePointer {
+			return "pointer expected"
+		}
+	default:
+		return fmt.Sprintf("unsupported kind %s", kind)
+	}
+
+	return ""
+}
+
+// matchStruct compares layout of Go struct against C one
+func matchStruct(typ reflect.Type, t *ctype) string {
+	if t.kind != ctypeStruct && t.kind != ctypeUnion {
+		return "pointer to struct expected"
+	}
+	if typ == nil {
+		return ""
+	}
+
+	l, err := layoutOf(typ)
+	if err != nil {
+		return err.Error()
+	}
+	if int64(l.size) != t.size {
+		return fmt.Sprintf("size of %s is %d, want %d", typ, l.size, t.size)
+	}
+	if len(l.fields) != len(t.members) {
+		return fmt.Sprintf("%s has %d fields, want %d", typ, len(l.fields), len(t.members))
+	}
+	for ii, f := range l.fields {
+		m := t.members[ii]
+		offset := int64(f.offset)
+		if m.bitSize != 0 {
+			offset = (int64(f.offset)*8 + int64(f.shift))
+			if offset != m.bitOffset || int64(f.bits) != m.bitSize {
+				return fmt.Sprintf("field %s.%s: bit offset %d, want %d", typ, f.name, offset, m.bitOffset)
+			}
+			continue
+		}
+		if offset != m.offset {
+			return fmt.Sprintf("field %s.%s: offset %d, want %d", typ, f.name, offset, m.offset)
+		}
+		if int64(f.size) != m.typ.size && m.typ.kind != ctypeArray {
+			return fmt.Sprintf("field %s.%s: size %d, want %d", typ, f.name, f.size, m.typ.size)
+		}
+	}
+
+	return ""
+}
+
+// formatArg returns definition of argument in C like form
+func formatArg(arg *Arg) string {
+	var typ string
+	switch arg.Type {
+	case reflect.UnsafePointer:
+		typ = "void"
+	case reflect.Struct:
+		typ = "struct"
+		if arg.Struct != nil && arg.Struct.Name() != "" {
+			typ = "struct " + arg.Struct.Name()
+		}
+	default:
+		typ = arg.Type.String()
+	}
+
+	if arg.Pointer {
+		return typ + " *"
+	}
+	return typ
+}
+
+// kindSize returns size of Go value of the kind
+func kindSize(kind reflect.Kind) int64 {
+	return int64(reflect.TypeOf(MakeValue(kind, false)).Size())
+}
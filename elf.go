@@ -0,0 +1,168 @@
+package dl
+
+import (
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Indirect function symbol type (GNU extension)
+const sttGNUIFunc = elf.SymType(10)
+
+// Export is a symbol exported by shared library
+type Export struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+	Type    string `json:"type"` // func, object, tls or ifunc
+	Weak    bool   `json:"weak,omitempty"`
+	Value   uint64 `json:"value"`
+	Size    uint64 `json:"size"`
+}
+
+// Exports returns symbols exported by ELF shared library sorted by name
+func Exports(path string) ([]Export, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("exports: %w", err)
+	}
+	defer f.Close()
+
+	syms, err := f.DynamicSymbols()
+	if err != nil {
+		return nil, fmt.Errorf("exports: %s: %w", path, err)
+	}
+
+	var res []Export
+	for _, sym := range syms {
+		if sym.Section == elf.SHN_UNDEF || sym.Name == "" {
+			continue
+		}
+		if sym.Section == elf.SHN_ABS && sym.Value == 0 {
+			// Version definition, like GLIBC_2.2.5
+			continue
+		}
+
+		bind := elf.ST_BIND(sym.Info)
+		if bind != elf.STB_GLOBAL && bind != elf.STB_WEAK {
+			continue
+		}
+
+		var typ string
+		switch elf.ST_TYPE(sym.Info) {
+		case elf.STT_FUNC:
+			typ = "func"
+		case elf.STT_OBJECT, elf.STT_COMMON:
+			typ = "object"
+		case elf.STT_TLS:
+			typ = "tls"
+		case sttGNUIFunc:
+			typ = "ifunc"
+		default:
+			continue
+		}
+
+		res = append(res, Export{
+			Name:    sym.Name,
+			Version: sym.Version,
+			Type:    typ,
+			Weak:    bind == elf.STB_WEAK,
+			Value:   sym.Value,
+			Size:    sym.Size,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Name == res[j].Name {
+			return res[i].Version < res[j].Version
+		}
+		return res[i].Name < res[j].Name
+	})
+
+	return res, nil
+}
+
+// Needed returns libraries needed by ELF shared library (DT_NEEDED entries)
+func Needed(path string) ([]string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("needed: %w", err)
+	}
+	defer f.Close()
+
+	libs, err := f.ImportedLibraries()
+	if err != nil {
+		return nil, fmt.Errorf("needed: %s: %w", path, err)
+	}
+
+	return libs, nil
+}
+
+// Default directories searched for shared libraries
+var libraryDirs = []string{
+	"/lib64",
+	"/usr/lib64",
+	"/lib/x86_64-linux-gnu",
+	"/usr/lib/x86_64-linux-gnu",
+	"/lib",
+	"/usr/lib",
+	"/usr/local/lib",
+}
+
+// Find returns path of the shared library file.
+// Name might be a path or a name of library with or without extension
+// (like "libc", "libc.so" or "libc.so.6"). Directories of LD_LIBRARY_PATH,
+// /etc/ld.so.conf and default system directories are searched. Files, which
+// are not ELF objects (like linker scripts) or can't be loaded into the
+// process (like 32-bit libraries), are skipped.
+func Find(name string) (string, error) {
+	if strings.ContainsRune(name, os.PathSeparator) {
+		if !isELF(name) {
+			return "", fmt.Errorf("find: %s is not an ELF object", name)
+		}
+		return filepath.Abs(name)
+	}
+
+	dirs := uniqueDirs(append(envDirs(), systemDirs()...))
+
+	names := []string{name}
+	if filepath.Ext(name) == "" {
+		names = append(names, name+".so")
+	}
+
+	for _, dir := range dirs {
+		for _, n := range names {
+			path := filepath.Join(dir, n)
+			if isLoadable(path) {
+				return path, nil
+			}
+		}
+
+		// Versioned file, like libc.so.6
+		matches, _ := filepath.Glob(filepath.Join(dir, names[len(names)-1]+".*"))
+		sort.Strings(matches)
+		for _, path := range matches {
+			if isLoadable(path) {
+				return path, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("find: %w: %s", ErrLibraryNotFound, name)
+}
+
+func isLoadable(path string) bool {
+	obj, err := ReadObject(path)
+	return err == nil && obj.Compatible() == nil
+}
+
+func isELF(path string) bool {
+	f, err := elf.Open(path)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
@@ -0,0 +1,91 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrLibraryNotFound is reported by Open, when the library or
+	// its dependency is missing (see LoadError for the reason)
+	ErrLibraryNotFound = errors.New("library not found")
+	// ErrIncompatibleLibrary is reported by Open, when the library or its
+	// dependency can't be loaded: it isn't a valid ELF object, is built for
+	// another architecture or has unresolved symbols
+	ErrIncompatibleLibrary = errors.New("incompatible library")
+	// ErrSymbolNotFound is reported, when symbol isn't exported by
+	// the library or routine isn't defined
+	ErrSymbolNotFound = errors.New("symbol not found")
+	// ErrClosed is reported by calls of closed library
+	ErrClosed = errors.New("library is closed")
+)
+
+// ArgumentError reports argument, which can't be passed to the routine
+type ArgumentError struct {
+	Routine string
+	Index   int    // Index of argument, -1 for wrong number of arguments
+	Want    string // Expected type or number of arguments
+	Got     string // Actual type or number of arguments
+	Err     error  // Reason of conversion failure, if any
+}
+
+func (e *ArgumentError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("%s: want %s, got %s", e.Routine, e.Want, e.Got)
+	}
+	msg := fmt.Sprintf("%s: argument %d: want %s, got %s", e.Routine, e.Index, e.Want, e.Got)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ArgumentError) Unwrap() error {
+	return e.Err
+}
+
+// argumentCount reports wrong number of arguments
+func argumentCount(routine *Routine, got int) *ArgumentError {
+	return &ArgumentError{
+		Routine: routine.Name,
+		Index:   -1,
+		Want:    fmt.Sprintf("%d arguments", len(routine.Args)),
+		Got:     fmt.Sprintf("%d", got),
+	}
+}
+
+// newArgumentError reports argument of the routine, which can't be converted or bound
+func newArgumentError(routine *Routine, index int, argument interface{}, err error) *ArgumentError {
+	return &ArgumentError{
+		Routine: routine.Name,
+		Index:   index,
+		Want:    formatArg(routine.Args[index]),
+		Got:     fmt.Sprintf("%T", argument),
+		Err:     err,
+	}
+}
+
+// ParseError reports invalid routine definition
+type ParseError struct {
+	Definition string
+	Pos        int // Byte offset of the problem in the definition
+	Msg        string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at %d in %q", e.Msg, e.Pos, e.Definition)
+}
+
+// loaderError is an error reported by the dynamic loader
+type loaderError struct {
+	msg  string
+	kind error // Sentinel matched by errors.Is
+}
+
+func (e *loaderError) Error() string {
+	return e.msg
+}
+
+func (e *loaderError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
@@ -0,0 +1,123 @@
+package dl
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// EventKind is a kind of lifecycle event
+type EventKind int
+
+const (
+	// EventOpen reports result of Open. When Open retries with another
+	// name (libc.so.6 for libc.so), only the last attempt is reported.
+	EventOpen EventKind = iota + 1
+	// EventDefine reports result of Define
+	EventDefine
+	// EventClose reports result of Close
+	EventClose
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventOpen:
+		return "open"
+	case EventDefine:
+		return "define"
+	case EventClose:
+		return "close"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes loading, definition of routine or closing of library
+type Event struct {
+	Kind EventKind
+	// Path of loaded library or name passed to the dynamic loader,
+	// when it wasn't loaded
+	Library string
+	Symbol  string // Name of the routine (EventDefine only)
+	Flags   int    // Flags of the dynamic loader (EventOpen only)
+	Err     error
+}
+
+// Hook receives lifecycle events of libraries.
+// Hooks are called synchronously and must not block.
+type Hook interface {
+	Event(e Event)
+}
+
+// HookFunc is a function used as Hook
+type HookFunc func(e Event)
+
+func (f HookFunc) Event(e Event) {
+	f(e)
+}
+
+var hooks struct {
+	sync.RWMutex
+	list []*Hook
+}
+
+// AddHook registers hook for events of all libraries
+// and returns function, which removes it
+func AddHook(hook Hook) (remove func()) {
+	h := &hook
+	hooks.Lock()
+	hooks.list = append(hooks.list[:len(hooks.list):len(hooks.list)], h)
+	hooks.Unlock()
+
+	return func() {
+		hooks.Lock()
+		defer hooks.Unlock()
+		for ii, p := range hooks.list {
+			if p == h {
+				hooks.list = append(hooks.list[:ii:ii], hooks.list[ii+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// WithHook adds hook for events of the library
+func WithHook(hook Hook) Option {
+	return func(cfg *config) {
+		cfg.hooks = append(cfg.hooks, hook)
+	}
+}
+
+// emit passes event to global hooks and hooks of the library
+func (cfg *config) emit(e Event) {
+	hooks.RLock()
+	list := hooks.list
+	hooks.RUnlock()
+
+	for _, h := range list {
+		(*h).Event(e)
+	}
+	for _, h := range cfg.hooks {
+		h.Event(e)
+	}
+}
+
+// SlogHook returns hook, which logs events with the logger:
+// successful ones at Debug level and failures at Error level
+func SlogHook(logger *slog.Logger) Hook {
+	return HookFunc(func(e Event) {
+		attrs := []slog.Attr{slog.String("library", e.Library)}
+		if e.Symbol != "" {
+			attrs = append(attrs, slog.String("symbol", e.Symbol))
+		}
+		if e.Kind == EventOpen {
+			attrs = append(attrs, slog.Int("flags", e.Flags))
+		}
+		level := slog.LevelDebug
+		if e.Err != nil {
+			level = slog.LevelError
+			attrs = append(attrs, slog.Any("error", e.Err))
+		}
+		logger.LogAttrs(context.Background(), level, "dl: "+e.Kind.String(), attrs...)
+	})
+}
@@ -0,0 +1,57 @@
+package dl
+
+// scope holds state shared by calls: options and retained arguments
+type scope struct {
+	pins    pinset // retained arguments
+	handles HandleScope
+	chain   Chain // interceptors of calls
+	stats   Stats
+	config  config
+}
+
+// Stats returns statistics of calls by routine name
+func (sc *scope) Stats() map[string]RoutineStats {
+	return sc.stats.Snapshot()
+}
+
+// publish exports statistics, when it is enabled by options
+func (sc *scope) publish() {
+	if sc.config.expvar != "" {
+		sc.stats.Publish(sc.config.expvar)
+	}
+}
+
+// Use adds interceptors of calls
+func (sc *scope) Use(interceptors ...Interceptor) {
+	sc.chain.Use(interceptors...)
+}
+
+// NewHandle returns handle of the value, which is deleted on Close
+func (sc *scope) NewHandle(v interface{}) Handle {
+	return sc.handles.NewHandle(v)
+}
+
+// Func is a routine bound to a raw code address by Bind
+type Func struct {
+	scope
+	routine *Routine
+}
+
+// Close releases arguments retained by calls of the function and its handles
+func (f *Func) Close() error {
+	f.pins.unpin()
+	f.handles.Release()
+	return nil
+}
+
+// Table is a function-pointer table bound by BindTable or BindObject
+type Table struct {
+	scope
+}
+
+// Close releases arguments retained by calls through the table and its handles
+func (t *Table) Close() error {
+	t.pins.unpin()
+	t.handles.Release()
+	return nil
+}
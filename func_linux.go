@@ -0,0 +1,215 @@
+// +build linux
+
+package dl
+
+/*
+#cgo LDFLAGS: -ldl
+#define _GNU_SOURCE
+#include <dlfcn.h>
+#include <stdint.h>
+#include <stdlib.h>
+
+static uintptr_t table_slot(uintptr_t table, size_t index)
+{
+    return ((const uintptr_t *)table)[index];
+}
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"unsafe"
+)
+
+// Bind binds routine to the code address, like a function pointer
+// returned by C, independently of any library. Name of the routine is
+// used in errors only, deallocator of the result is searched globally.
+// Option WithCodeCheck validates the address before binding.
+func Bind(addr uintptr, routine *Routine, options ...Option) (*Func, error) {
+	if routine == nil {
+		return nil, errors.New("bind: routine is nil")
+	}
+	if addr == 0 {
+		return nil, fmt.Errorf("bind %s: NULL address", routine.Name)
+	}
+	if err := routine.Validate(); err != nil {
+		return nil, fmt.Errorf("bind %s: %w", routine.Name, err)
+	}
+
+	f := &Func{scope: scope{config: newConfig(options)}}
+	if f.config.checkCode {
+		if err := checkCode(addr); err != nil {
+			return nil, fmt.Errorf("bind %s: %w", routine.Name, err)
+		}
+	}
+
+	// Routine might be bound to several addresses
+	r := *routine
+	r.handle = cPointer(addr)
+	if r.Result != nil && r.Result.Ownership == OwnedDeallocator {
+		d := C.CString(r.Result.Deallocator)
+		defer C.free(unsafe.Pointer(d))
+
+		mu.Lock()
+		runtime.LockOSThread()
+		dealloc := C.dlsym(C.RTLD_DEFAULT, d)
+		if dealloc == nil {
+			err := dlerror(ErrSymbolNotFound)
+			runtime.UnlockOSThread()
+			mu.Unlock()
+			return nil, fmt.Errorf("bind %s: deallocator: %w", routine.Name, err)
+		}
+		runtime.UnlockOSThread()
+		mu.Unlock()
+		r.dealloc = uintptr(dealloc)
+	}
+	f.routine = &r
+	f.publish()
+
+	return f, nil
+}
+
+// Call calls the function with arguments converted according to the routine
+func (f *Func) Call(arguments ...interface{}) (interface{}, error) {
+	return f.call(context.Background(), f.routine, arguments, nil)
+}
+
+// Func makes typed Go function calling the code, out must be a pointer
+// to variable of func type (like Symbol does). Ownership of the result
+// follows the routine.
+func (f *Func) Func(out interface{}) error {
+	val := reflect.ValueOf(out)
+	if !val.IsValid() || val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("func: out must be a pointer to func, not %T", out)
+	}
+
+	typ := val.Elem().Type()
+	tr, err := makeTrampoline(&f.scope, f.routine.Name, typ, f.routine.handle, f.routine)
+	if err != nil {
+		return fmt.Errorf("func: %w", err)
+	}
+	val.Elem().Set(reflect.MakeFunc(typ, tr))
+
+	return nil
+}
+
+// checkCode validates, that address lies in executable mapping of a loaded object
+func checkCode(addr uintptr) error {
+	if _, err := Addr(addr); err != nil {
+		return err
+	}
+	return checkMapping(addr, 1, 'x')
+}
+
+// BindTable fills struct of func fields (pointed by out) with functions
+// calling through the table of function pointers, like
+// struct plugin_api { int (*init)(void *); void (*shutdown)(void *); }.
+// Every field takes one pointer slot in order: func fields are bound
+// (left nil for NULL slots), uintptr and unsafe.Pointer fields receive the
+// raw slot value and fields named _ skip the slot. When this is not zero,
+// it is passed as implicit first argument to all functions except fields
+// tagged `dl:"static"`.
+// Interfaces aren't supported: out can't point to interface and fields of
+// interface type are rejected, since methods can't be made by reflection.
+// Implement the interface with methods calling fields of the struct instead.
+func BindTable(table, this uintptr, out interface{}, options ...Option) (*Table, error) {
+	val := reflect.ValueOf(out)
+	if !val.IsValid() || val.Kind() != reflect.Ptr || val.IsNil() || val.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("bind table: out must be a pointer to struct, not %T", out)
+	}
+	if table == 0 {
+		return nil, errors.New("bind table: NULL table")
+	}
+
+	t := &Table{scope: scope{config: newConfig(options)}}
+	elem := val.Elem()
+	typ := elem.Type()
+	for ii := 0; ii < typ.NumField(); ii++ {
+		sf := typ.Field(ii)
+		slot := uintptr(C.table_slot(C.uintptr_t(table), C.size_t(ii)))
+		if sf.Name == "_" {
+			continue
+		}
+		if !sf.IsExported() {
+			return nil, fmt.Errorf("bind table: field %s is not exported", sf.Name)
+		}
+
+		field := elem.Field(ii)
+		switch sf.Type.Kind() {
+		case reflect.Uintptr:
+			field.SetUint(uint64(slot))
+			continue
+		case reflect.UnsafePointer:
+			field.SetPointer(cPointer(slot))
+			continue
+		case reflect.Func:
+		default:
+			return nil, fmt.Errorf("bind table: field %s: unsupported type %s", sf.Name, sf.Type)
+		}
+
+		if slot == 0 {
+			field.Set(reflect.Zero(sf.Type))
+			continue
+		}
+		if t.config.checkCode {
+			if err := checkCode(slot); err != nil {
+				return nil, fmt.Errorf("bind table: field %s: %w", sf.Name, err)
+			}
+		}
+
+		fn, err := t.method(sf, slot, this)
+		if err != nil {
+			return nil, fmt.Errorf("bind table: field %s: %w", sf.Name, err)
+		}
+		field.Set(fn)
+	}
+
+	t.publish()
+	return t, nil
+}
+
+// BindObject binds COM-like object, which first field is a pointer to
+// the table of methods. Object is passed as implicit first argument.
+func BindObject(object uintptr, out interface{}, options ...Option) (*Table, error) {
+	if object == 0 {
+		return nil, errors.New("bind object: NULL object")
+	}
+
+	vtable := uintptr(C.table_slot(C.uintptr_t(object), 0))
+	return BindTable(vtable, object, out, options...)
+}
+
+// method makes Go function calling code at address
+func (t *Table) method(sf reflect.StructField, addr, this uintptr) (reflect.Value, error) {
+	typ := sf.Type
+	if this == 0 || sf.Tag.Get("dl") == "static" {
+		tr, err := makeTrampoline(&t.scope, sf.Name, typ, cPointer(addr), nil)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.MakeFunc(typ, tr), nil
+	}
+
+	// C function takes object as the first argument (passed as address)
+	in := []reflect.Type{reflect.TypeOf(uintptr(0))}
+	for ii := 0; ii < typ.NumIn(); ii++ {
+		in = append(in, typ.In(ii))
+	}
+	out := make([]reflect.Type, typ.NumOut())
+	for ii := range out {
+		out[ii] = typ.Out(ii)
+	}
+	tr, err := makeTrampoline(&t.scope, sf.Name, reflect.FuncOf(in, out, typ.IsVariadic()), cPointer(addr), nil)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	self := reflect.ValueOf(this)
+	return reflect.MakeFunc(typ, func(args []reflect.Value) []reflect.Value {
+		return tr(append([]reflect.Value{self}, args...))
+	}), nil
+}
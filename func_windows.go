@@ -0,0 +1,33 @@
+// +build windows
+
+package dl
+
+import "errors"
+
+// Bind binds routine to the code address
+func Bind(addr uintptr, routine *Routine, options ...Option) (*Func, error) {
+	// Not yet implemented
+	return nil, errors.New("bind: not supported")
+}
+
+// Call calls the function with arguments converted according to the routine
+func (f *Func) Call(arguments ...interface{}) (interface{}, error) {
+	return nil, errors.New("call: not supported")
+}
+
+// Func makes typed Go function calling the code
+func (f *Func) Func(out interface{}) error {
+	return errors.New("func: not supported")
+}
+
+// BindTable fills struct of func fields with functions calling through the table
+func BindTable(table, this uintptr, out interface{}, options ...Option) (*Table, error) {
+	// Not yet implemented
+	return nil, errors.New("bind table: not supported")
+}
+
+// BindObject binds COM-like object
+func BindObject(object uintptr, out interface{}, options ...Option) (*Table, error) {
+	// Not yet implemented
+	return nil, errors.New("bind object: not supported")
+}
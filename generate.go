@@ -0,0 +1,307 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"unsafe"
+)
+
+// GenerateRoutines builds routine definitions from DWARF debug info of the
+// library. When names are omitted, all exported functions are described.
+// Structs passed by pointer get Go types with the same C layout, opaque
+// structs and other pointers become void *, const char * becomes string
+// and other char * become pointers to uint8 (buffers filled by C).
+// Routines, which can't be described (like variadic ones), are skipped
+// and reported by the error, while the rest are still returned.
+func GenerateRoutines(path string, names ...string) ([]*Routine, error) {
+	info, err := loadDebugInfo(path)
+	if err != nil {
+		return nil, fmt.Errorf("generate: %w", err)
+	}
+
+	if len(names) == 0 {
+		exports, err := Exports(path)
+		if err != nil {
+			return nil, fmt.Errorf("generate: %w", err)
+		}
+		for _, e := range exports {
+			if e.Type != "func" || info.funcs[e.Name] == nil {
+				continue
+			}
+			if len(names) != 0 && names[len(names)-1] == e.Name {
+				// Another version of the same symbol
+				continue
+			}
+			names = append(names, e.Name)
+		}
+	}
+
+	g := &generator{
+		structs: make(map[*ctype]reflect.Type),
+		layouts: make(map[string]reflect.Type),
+	}
+	var res []*Routine
+	var errs []error
+	for _, name := range names {
+		fn, ok := info.funcs[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: no debug info for routine", name))
+			continue
+		}
+		routine, err := g.routine(fn)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		res = append(res, routine)
+	}
+
+	if len(errs) != 0 {
+		return res, fmt.Errorf("generate: %w", errors.Join(errs...))
+	}
+
+	return res, nil
+}
+
+// FormatRoutine returns definition of routine accepted by ParseRoutineDefinition.
+// Go types of structs are not preserved.
+func FormatRoutine(routine *Routine) (string, error) {
+	args := make([]string, len(routine.Args))
+	for ii, arg := range routine.Args {
+		s, err := formatType(arg)
+		if err != nil {
+			return "", fmt.Errorf("FormatRoutine: %s: argument %d: %w", routine.Name, ii, err)
+		}
+		args[ii] = s
+	}
+
+	res := "void"
+	if routine.Result != nil {
+		var err error
+		res, err = formatType(routine.Result)
+		if err != nil {
+			return "", fmt.Errorf("FormatRoutine: %s: result: %w", routine.Name, err)
+		}
+	}
+
+	if strings.HasSuffix(res, "*") {
+		return fmt.Sprintf("%s%s(%s)", res, routine.Name, strings.Join(args, ", ")), nil
+	}
+	return fmt.Sprintf("%s %s(%s)", res, routine.Name, strings.Join(args, ", ")), nil
+}
+
+// formatType returns name of argument type known by the parser
+func formatType(arg *Arg) (string, error) {
+	for name, kind := range types {
+		if kind != arg.Type {
+			continue
+		}
+		if arg.Pointer {
+			return name + " *", nil
+		}
+		if kind == reflect.Struct || kind == reflect.UnsafePointer {
+			break
+		}
+		return name, nil
+	}
+
+	return "", fmt.Errorf("unsupported type %s", formatArg(arg))
+}
+
+// generator converts C types into Go ones
+type generator struct {
+	structs map[*ctype]reflect.Type
+	layouts map[string]reflect.Type // by C layout, structs repeat in compile units
+}
+
+func (g *generator) routine(fn *cfunc) (*Routine, error) {
+	if fn.variadic {
+		return nil, errors.New("variadic functions are not supported")
+	}
+
+	routine := &Routine{
+		Name: fn.name,
+		Args: make([]*Arg, 0, len(fn.params)),
+	}
+	for ii, p := range fn.params {
+		arg, err := g.arg(p)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %w", ii, err)
+		}
+		routine.Args = append(routine.Args, arg)
+	}
+
+	if fn.result != nil && fn.result.kind != ctypeVoid {
+		res, err := g.arg(fn.result)
+		if err != nil {
+			return nil, fmt.Errorf("result: %w", err)
+		}
+		routine.Result = res
+	}
+
+	return routine, nil
+}
+
+func (g *generator) arg(t *ctype) (*Arg, error) {
+	if t.kind != ctypePointer {
+		kind, err := scalarKind(t)
+		if err != nil {
+			return nil, err
+		}
+		return &Arg{Type: kind}, nil
+	}
+
+	elem := t.elem
+	switch elem.kind {
+	case ctypeChar:
+		if elem.readonly {
+			return &Arg{Type: reflect.String}, nil
+		}
+		return &Arg{Type: reflect.Uint8, Pointer: true}, nil
+	case ctypeStruct, ctypeUnion:
+		if len(elem.members) == 0 {
+			// Opaque struct
+			return &Arg{Type: reflect.UnsafePointer, Pointer: true}, nil
+		}
+		typ, err := g.structType(elem)
+		if err != nil {
+			return nil, err
+		}
+		return &Arg{Type: reflect.Struct, Pointer: true, Struct: typ}, nil
+	}
+
+	if kind, err := scalarKind(elem); err == nil {
+		return &Arg{Type: kind, Pointer: true}, nil
+	}
+	return &Arg{Type: reflect.UnsafePointer, Pointer: true}, nil
+}
+
+// scalarKind returns kind of Go value matching C scalar type
+func scalarKind(t *ctype) (reflect.Kind, error) {
+	switch t.kind {
+	case ctypeInt, ctypeUint, ctypeChar:
+		var kinds []reflect.Kind
+		if t.signed {
+			kinds = []reflect.Kind{reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64}
+		} else {
+			kinds = []reflect.Kind{reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64}
+		}
+		for _, kind := range kinds {
+			if kindSize(kind) == t.size {
+				return kind, nil
+			}
+		}
+	case ctypeBool:
+		if t.size == 1 {
+			return reflect.Bool, nil
+		}
+	case ctypeFloat:
+		switch t.size {
+		case 4:
+			return reflect.Float32, nil
+		case 8:
+			return reflect.Float64, nil
+		}
+	case ctypeStruct, ctypeUnion:
+		return reflect.Invalid, errors.New("structs passed by value are not supported")
+	}
+
+	return reflect.Invalid, fmt.Errorf("unsupported type %s", t)
+}
+
+// Names of marker fields, which carry options of generated structs
+const (
+	unionMarker = "Union_"
+	packMarker  = "Pack_"
+)
+
+// structType builds Go struct with the same layout as C one
+func (g *generator) structType(t *ctype) (reflect.Type, error) {
+	if typ, ok := g.structs[t]; ok {
+		return typ, nil
+	}
+	key := t.layout()
+	if typ, ok := g.layouts[key]; ok {
+		g.structs[t] = typ
+		return typ, nil
+	}
+
+	used := map[string]bool{unionMarker: true, packMarker: true}
+	var fields []reflect.StructField
+	if t.kind == ctypeUnion {
+		fields = append(fields, reflect.StructField{Name: unionMarker, Type: markerType, Tag: `dl:"union"`})
+	}
+	for ii, m := range t.members {
+		typ, err := g.fieldType(m.typ)
+		if err != nil {
+			return nil, fmt.Errorf("%s: field %s: %w", t, m.name, err)
+		}
+		f := reflect.StructField{Name: fieldName(m.name, ii, used), Type: typ}
+		if m.bitSize != 0 {
+			f.Tag = reflect.StructTag(fmt.Sprintf(`dl:"bits=%d"`, m.bitSize))
+		}
+		fields = append(fields, f)
+	}
+
+	// Packed structs are detected by offsets of fields
+	for _, pack := range []int{0, 1, 2, 4} {
+		ff := fields
+		if pack != 0 {
+			marker := reflect.StructField{Name: packMarker, Type: markerType, Tag: reflect.StructTag(fmt.Sprintf(`dl:"pack=%d"`, pack))}
+			ff = append([]reflect.StructField{marker}, fields...)
+		}
+		typ := reflect.StructOf(ff)
+		if matchStruct(typ, t) == "" {
+			g.structs[t] = typ
+			g.layouts[key] = typ
+			return typ, nil
+		}
+	}
+
+	return nil, fmt.Errorf("layout of %s is not supported", t)
+}
+
+// fieldType returns Go type of struct field
+func (g *generator) fieldType(t *ctype) (reflect.Type, error) {
+	switch t.kind {
+	case ctypePointer:
+		return reflect.TypeOf(unsafe.Pointer(nil)), nil
+	case ctypeStruct, ctypeUnion:
+		return g.structType(t)
+	case ctypeArray:
+		elem, err := g.fieldType(t.elem)
+		if err != nil {
+			return nil, err
+		}
+		length := 0
+		if elem.Size() != 0 {
+			length = int(t.size) / int(elem.Size())
+		}
+		return reflect.ArrayOf(length, elem), nil
+	}
+
+	kind, err := scalarKind(t)
+	if err != nil {
+		return nil, err
+	}
+	return reflect.TypeOf(MakeValue(kind, false)), nil
+}
+
+// fieldName returns unique exported name of Go field
+func fieldName(name string, index int, used map[string]bool) string {
+	if name == "" {
+		name = fmt.Sprintf("Field%d", index)
+	}
+	res := strings.ToUpper(name[:1]) + name[1:]
+	if res[0] == '_' {
+		res = "X" + res
+	}
+	for used[res] {
+		res += "_"
+	}
+	used[res] = true
+
+	return res
+}
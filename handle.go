@@ -0,0 +1,138 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// ErrInvalidHandle is returned for values, which were never made by NewHandle
+	ErrInvalidHandle = errors.New("invalid handle")
+	// ErrStaleHandle is returned for handles, which were already deleted
+	ErrStaleHandle = errors.New("stale handle")
+)
+
+// Handle is an opaque reference to Go value, which might be passed to C
+// as void * (like user data of callbacks) and turned back into the value.
+// Handle is passed by Call and functions as an integer, it never
+// becomes a Go pointer.
+type Handle uintptr
+
+// Bits of generation of the slot, which detect stale handles
+const handleGenBits = 16
+
+// handleSlot keeps value referenced by handle
+type handleSlot struct {
+	value interface{}
+	gen   uintptr
+	used  bool
+}
+
+var registry struct {
+	sync.Mutex
+	slots []handleSlot
+	free  []int
+}
+
+// NewHandle returns handle of the value. Handle must be deleted,
+// when C doesn't reference it anymore, or released by the scope.
+func NewHandle(v interface{}) Handle {
+	registry.Lock()
+	defer registry.Unlock()
+
+	var index int
+	if n := len(registry.free); n != 0 {
+		index = registry.free[n-1]
+		registry.free = registry.free[:n-1]
+	} else {
+		index = len(registry.slots)
+		registry.slots = append(registry.slots, handleSlot{})
+	}
+
+	slot := &registry.slots[index]
+	slot.value = v
+	slot.used = true
+
+	return Handle(uintptr(index+1)<<handleGenBits | slot.gen)
+}
+
+// HandleOf converts pointer received from C (uintptr or unsafe.Pointer) into handle
+func HandleOf(ptr interface{}) (Handle, error) {
+	addr, err := addressOf(ptr)
+	if err != nil {
+		return 0, fmt.Errorf("handle: %w", err)
+	}
+	return Handle(addr), nil
+}
+
+// slot returns slot of the handle, registry must be locked
+func (h Handle) slot() (*handleSlot, error) {
+	index := int(uintptr(h)>>handleGenBits) - 1
+	if index < 0 || index >= len(registry.slots) {
+		return nil, fmt.Errorf("handle %#x: %w", uintptr(h), ErrInvalidHandle)
+	}
+	slot := &registry.slots[index]
+	if !slot.used || slot.gen != uintptr(h)&(1<<handleGenBits-1) {
+		return nil, fmt.Errorf("handle %#x: %w", uintptr(h), ErrStaleHandle)
+	}
+	return slot, nil
+}
+
+// Value returns value referenced by handle
+func (h Handle) Value() (interface{}, error) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	slot, err := h.slot()
+	if err != nil {
+		return nil, err
+	}
+	return slot.value, nil
+}
+
+// Delete releases the handle, further uses of it are reported as stale
+func (h Handle) Delete() error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	slot, err := h.slot()
+	if err != nil {
+		return err
+	}
+	slot.value = nil
+	slot.used = false
+	slot.gen = (slot.gen + 1) & (1<<handleGenBits - 1)
+	registry.free = append(registry.free, int(uintptr(h)>>handleGenBits)-1)
+
+	return nil
+}
+
+// HandleScope releases handles tied to one library or subsystem at once
+type HandleScope struct {
+	sync.Mutex
+	handles []Handle
+}
+
+// NewHandle returns handle of the value, which is deleted by Release
+func (s *HandleScope) NewHandle(v interface{}) Handle {
+	h := NewHandle(v)
+
+	s.Lock()
+	s.handles = append(s.handles, h)
+	s.Unlock()
+
+	return h
+}
+
+// Release deletes all handles of the scope, which were not deleted yet
+func (s *HandleScope) Release() {
+	s.Lock()
+	list := s.handles
+	s.handles = nil
+	s.Unlock()
+
+	for _, h := range list {
+		_ = h.Delete()
+	}
+}
@@ -0,0 +1,19 @@
+package dl
+
+// Info describes loaded library
+type Info struct {
+	Path    string  `json:"path"`               // Absolute path of the loaded file
+	Base    uintptr `json:"base"`               // Load base address
+	SOName  string  `json:"soname,omitempty"`   // DT_SONAME
+	BuildID string  `json:"build_id,omitempty"` // GNU build-id
+	Flags   int     `json:"flags"`              // Flags passed to Open
+	// Entries of the link map for the library and its loaded
+	// dependencies (DT_NEEDED closure), in load order
+	LinkMap []Loaded `json:"link_map"`
+}
+
+// Loaded is an entry of the link map
+type Loaded struct {
+	Path string  `json:"path"`
+	Base uintptr `json:"base"`
+}
@@ -0,0 +1,65 @@
+package dl
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// CallInfo describes intercepted call of the routine
+type CallInfo struct {
+	Name string
+	// Definition of the routine, nil for functions retrieved
+	// by Symbol or bound by BindTable without definition
+	Routine *Routine
+	// Arguments converted according to the definition. Interceptors
+	// may pass changed copy to next, original slice must not be modified.
+	Args []interface{}
+	// Time when the call entered the chain, time.Since(ctx.Start)
+	// after next returns is the duration of the call
+	Start time.Time
+	// Context of the call: the one passed to CallContext (background
+	// otherwise) with pprof labels, which are set during the call
+	Context context.Context
+}
+
+// Invoker continues the call: runs the next interceptor or the routine itself
+type Invoker func(ctx CallInfo) (interface{}, error)
+
+// Interceptor wraps calls of routines. It may inspect or change
+// arguments, result and error, or skip the call without invoking next.
+type Interceptor func(ctx CallInfo, next Invoker) (interface{}, error)
+
+// Chain is a list of interceptors safe for concurrent use.
+// It helps other implementations of Library to support Use.
+type Chain struct {
+	mu   sync.RWMutex
+	list []Interceptor
+}
+
+// Use appends interceptors to the chain. The first one is the outermost.
+func (c *Chain) Use(interceptors ...Interceptor) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.list = append(c.list[:len(c.list):len(c.list)], interceptors...)
+}
+
+// Invoke runs the call through interceptors of the chain
+func (c *Chain) Invoke(ctx CallInfo, invoke Invoker) (interface{}, error) {
+	c.mu.RLock()
+	list := c.list
+	c.mu.RUnlock()
+
+	ctx.Start = time.Now()
+	if ctx.Context == nil {
+		ctx.Context = context.Background()
+	}
+	next := invoke
+	for ii := len(list) - 1; ii >= 0; ii-- {
+		interceptor, inner := list[ii], next
+		next = func(ctx CallInfo) (interface{}, error) {
+			return interceptor(ctx, inner)
+		}
+	}
+	return next(ctx)
+}
@@ -0,0 +1,643 @@
+package dl
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Layout of C structures is described by Go structs.
+// Fields are mapped according to the type mapping of the package
+// and aligned by the natural alignment rules of x86-64 System V ABI.
+// Options of fields are declared with `dl` tag:
+//
+//   _    struct{} `dl:"pack=1"`   maximum alignment of fields, like #pragma pack(1)
+//   _    struct{} `dl:"union"`    all fields share the same memory (C union)
+//   Name string   `dl:"char[16]"` fixed size array of chars
+//   Mode uint32   `dl:"bits=3"`   bit-field of the given width
+//   Tmp  int      `dl:"-"`        field is not a part of C structure
+//
+// Fixed size arrays, nested structs and pointer fields (unsafe.Pointer,
+// uintptr and typed pointers) are supported as well.
+//
+// Bit-fields are allocated like GCC does on x86-64: a bit-field never crosses
+// the boundary of the naturally aligned storage unit of its type, unless the
+// struct is packed. Signed bit-fields are sign extended.
+//
+// All fields of a union are decoded from the same memory. Since fields of
+// a union overlap, only one field should be set before passing it to C:
+// non-zero fields are written in declaration order.
+
+type fieldKind int
+
+const (
+	fieldScalar fieldKind = iota
+	fieldPointer
+	fieldChars
+	fieldArray
+	fieldStruct
+	fieldBits
+)
+
+// cfield describes C representation of Go value
+type cfield struct {
+	name   string
+	index  int // index of Go field
+	kind   fieldKind
+	offset uintptr
+	size   uintptr
+	align  uintptr
+	bits   int // width of bit-field
+	shift  int // offset of bit-field in bits relative to offset
+	typ    reflect.Type
+	length int     // length of array or chars
+	elem   *cfield // element of array
+	layout *layout // nested struct
+}
+
+// layout describes C representation of Go struct
+type layout struct {
+	typ    reflect.Type
+	size   uintptr
+	align  uintptr
+	union  bool
+	fields []*cfield
+	// Go memory layout matches C layout, so values might be passed in place
+	inplace bool
+}
+
+type tagOptions struct {
+	skip  bool
+	union bool
+	pack  uintptr
+	chars int
+	bits  int
+}
+
+var layouts sync.Map // reflect.Type => *layout
+
+// Type of fields, which only carry options (like _ struct{} `dl:"union"`)
+var markerType = reflect.TypeOf(struct{}{})
+
+// layoutOf returns C layout of struct type
+func layoutOf(typ reflect.Type) (*layout, error) {
+	if l, ok := layouts.Load(typ); ok {
+		return l.(*layout), nil
+	}
+
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("layout: %s is not a struct", typ)
+	}
+
+	l, err := newLayout(typ)
+	if err != nil {
+		return nil, fmt.Errorf("layout of %s: %w", typ, err)
+	}
+
+	layouts.Store(typ, l)
+	return l, nil
+}
+
+func newLayout(typ reflect.Type) (*layout, error) {
+	l := &layout{
+		typ:     typ,
+		align:   1,
+		inplace: true,
+	}
+
+	var pack uintptr
+	for ii := 0; ii < typ.NumField(); ii++ {
+		sf := typ.Field(ii)
+		opts, err := parseTag(sf.Tag.Get("dl"))
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+		if opts.pack != 0 {
+			pack = opts.pack
+		}
+		if opts.union {
+			l.union = true
+		}
+		if opts.skip || sf.Name == "_" || sf.Type == markerType {
+			if sf.Type.Size() != 0 {
+				l.inplace = false
+			}
+			continue
+		}
+
+		f, err := newField(sf.Type, opts)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", sf.Name, err)
+		}
+		f.name = sf.Name
+		f.index = ii
+		l.fields = append(l.fields, f)
+	}
+
+	// Allocate fields, offsets are counted in bits because of bit-fields
+	var pos, end uintptr
+	for _, f := range l.fields {
+		align := f.align
+		if pack != 0 && align > pack {
+			align = pack
+		}
+		if l.union {
+			pos = 0
+		}
+
+		if f.kind == fieldBits {
+			unit := f.size * 8
+			if pack == 0 && pos%unit+uintptr(f.bits) > unit {
+				// Bit-field doesn't cross boundary of its storage unit
+				pos = alignUp(pos, unit)
+			}
+			f.offset = pos / 8
+			f.shift = int(pos % 8)
+			pos += uintptr(f.bits)
+		} else {
+			f.offset = alignUp((pos+7)/8, align)
+			pos = (f.offset + f.size) * 8
+		}
+
+		if pos > end {
+			end = pos
+		}
+		if align > l.align {
+			l.align = align
+		}
+
+		sf := typ.Field(f.index)
+		if sf.Offset != f.offset || !f.inplace() {
+			l.inplace = false
+		}
+	}
+
+	l.size = alignUp((end+7)/8, l.align)
+	if l.size != typ.Size() || l.union && len(l.fields) > 1 {
+		l.inplace = false
+	}
+
+	return l, nil
+}
+
+func newField(typ reflect.Type, opts tagOptions) (*cfield, error) {
+	f := &cfield{typ: typ}
+
+	if opts.bits != 0 {
+		switch typ.Kind() {
+		case reflect.Bool,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		default:
+			return nil, fmt.Errorf("bit-field requires integer, not %s", typ)
+		}
+		if uintptr(opts.bits) > typ.Size()*8 {
+			return nil, fmt.Errorf("width of bit-field exceeds its type %s", typ)
+		}
+		f.kind = fieldBits
+		f.bits = opts.bits
+		f.size = typ.Size()
+		f.align = typ.Size()
+		return f, nil
+	}
+
+	if opts.chars != 0 {
+		if typ.Kind() != reflect.String {
+			return nil, fmt.Errorf("char[%d] requires string, not %s", opts.chars, typ)
+		}
+		f.kind = fieldChars
+		f.length = opts.chars
+		f.size = uintptr(opts.chars)
+		f.align = 1
+		return f, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr, reflect.Float32, reflect.Float64:
+		f.kind = fieldScalar
+		f.size = typ.Size()
+		f.align = typ.Size()
+	case reflect.Ptr, reflect.UnsafePointer:
+		f.kind = fieldPointer
+		f.size = unsafe.Sizeof(uintptr(0))
+		f.align = f.size
+	case reflect.Array:
+		elem, err := newField(typ.Elem(), tagOptions{})
+		if err != nil {
+			return nil, err
+		}
+		f.kind = fieldArray
+		f.elem = elem
+		f.length = typ.Len()
+		f.size = elem.size * uintptr(f.length)
+		f.align = elem.align
+	case reflect.Struct:
+		l, err := layoutOf(typ)
+		if err != nil {
+			return nil, err
+		}
+		f.kind = fieldStruct
+		f.layout = l
+		f.size = l.size
+		f.align = l.align
+	case reflect.String:
+		return nil, errors.New("string requires char[N] tag")
+	default:
+		return nil, fmt.Errorf("unsupported type %s", typ)
+	}
+
+	return f, nil
+}
+
+// inplace returns true, when Go representation of field matches C one
+func (f *cfield) inplace() bool {
+	switch f.kind {
+	case fieldScalar, fieldPointer:
+		return true
+	case fieldArray:
+		return f.elem.inplace() && f.elem.size == f.typ.Elem().Size()
+	case fieldStruct:
+		return f.layout.inplace
+	default:
+		return false
+	}
+}
+
+func parseTag(tag string) (opts tagOptions, err error) {
+	if tag == "" {
+		return
+	}
+	if tag == "-" {
+		opts.skip = true
+		return
+	}
+
+	for _, opt := range strings.Split(tag, ",") {
+		opt = strings.TrimSpace(opt)
+		switch {
+		case opt == "union":
+			opts.union = true
+		case strings.HasPrefix(opt, "bits="):
+			n, err := strconv.Atoi(opt[len("bits="):])
+			if err != nil || n <= 0 || n > 64 {
+				return opts, fmt.Errorf("invalid option %q", opt)
+			}
+			opts.bits = n
+		case strings.HasPrefix(opt, "pack="):
+			n, err := strconv.ParseUint(opt[len("pack="):], 10, 8)
+			if err != nil || n == 0 || n&(n-1) != 0 {
+				return opts, fmt.Errorf("invalid option %q", opt)
+			}
+			opts.pack = uintptr(n)
+		case strings.HasPrefix(opt, "char[") && strings.HasSuffix(opt, "]"):
+			n, err := strconv.Atoi(opt[len("char[") : len(opt)-1])
+			if err != nil || n <= 0 {
+				return opts, fmt.Errorf("invalid option %q", opt)
+			}
+			opts.chars = n
+		default:
+			return opts, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+
+	return
+}
+
+func alignUp(offset, align uintptr) uintptr {
+	return (offset + align - 1) &^ (align - 1)
+}
+
+// store writes Go value into C memory
+func (l *layout) store(dst unsafe.Pointer, v reflect.Value) {
+	if l.union {
+		buf := unsafe.Slice((*byte)(dst), l.size)
+		for ii := range buf {
+			buf[ii] = 0
+		}
+	}
+
+	for _, f := range l.fields {
+		fv := v.Field(f.index)
+		if l.union && fv.IsZero() {
+			continue
+		}
+		f.store(unsafe.Add(dst, f.offset), fv)
+	}
+}
+
+// load reads Go value from C memory
+func (l *layout) load(src unsafe.Pointer, v reflect.Value) {
+	for _, f := range l.fields {
+		f.load(unsafe.Add(src, f.offset), v.Field(f.index))
+	}
+}
+
+func (f *cfield) store(dst unsafe.Pointer, v reflect.Value) {
+	switch f.kind {
+	case fieldScalar:
+		copy(unsafe.Slice((*byte)(dst), f.size), unsafe.Slice((*byte)(v.Addr().UnsafePointer()), f.size))
+	case fieldPointer:
+		p := v.Pointer()
+		copy(unsafe.Slice((*byte)(dst), f.size), unsafe.Slice((*byte)(unsafe.Pointer(&p)), f.size))
+	case fieldChars:
+		buf := unsafe.Slice((*byte)(dst), f.length)
+		n := copy(buf[:f.length-1], v.String())
+		for ii := n; ii < f.length; ii++ {
+			buf[ii] = 0
+		}
+	case fieldArray:
+		for ii := 0; ii < f.length; ii++ {
+			f.elem.store(unsafe.Add(dst, uintptr(ii)*f.elem.size), v.Index(ii))
+		}
+	case fieldStruct:
+		f.layout.store(dst, v)
+	case fieldBits:
+		var x uint64
+		switch v.Kind() {
+		case reflect.Bool:
+			if v.Bool() {
+				x = 1
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			x = uint64(v.Int())
+		default:
+			x = v.Uint()
+		}
+		buf := unsafe.Slice((*byte)(dst), (f.shift+f.bits+7)/8)
+		for ii := 0; ii < f.bits; ii++ {
+			pos := f.shift + ii
+			mask := byte(1) << (pos % 8)
+			if x&(1<<ii) != 0 {
+				buf[pos/8] |= mask
+			} else {
+				buf[pos/8] &^= mask
+			}
+		}
+	}
+}
+
+func (f *cfield) load(src unsafe.Pointer, v reflect.Value) {
+	switch f.kind {
+	case fieldScalar:
+		copy(unsafe.Slice((*byte)(v.Addr().UnsafePointer()), f.size), unsafe.Slice((*byte)(src), f.size))
+	case fieldPointer:
+		var p unsafe.Pointer
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&p)), f.size), unsafe.Slice((*byte)(src), f.size))
+		if v.Kind() == reflect.UnsafePointer {
+			v.SetPointer(p)
+		} else {
+			v.Set(reflect.NewAt(f.typ.Elem(), p))
+		}
+	case fieldChars:
+		buf := unsafe.Slice((*byte)(src), f.length)
+		n := 0
+		for n < f.length && buf[n] != 0 {
+			n++
+		}
+		v.SetString(string(buf[:n]))
+	case fieldArray:
+		for ii := 0; ii < f.length; ii++ {
+			f.elem.load(unsafe.Add(src, uintptr(ii)*f.elem.size), v.Index(ii))
+		}
+	case fieldStruct:
+		f.layout.load(src, v)
+	case fieldBits:
+		var x uint64
+		buf := unsafe.Slice((*byte)(src), (f.shift+f.bits+7)/8)
+		for ii := 0; ii < f.bits; ii++ {
+			pos := f.shift + ii
+			if buf[pos/8]&(byte(1)<<(pos%8)) != 0 {
+				x |= 1 << ii
+			}
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			v.SetBool(x != 0)
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			// Sign extension
+			shift := 64 - f.bits
+			v.SetInt(int64(x<<shift) >> shift)
+		default:
+			v.SetUint(x)
+		}
+	}
+}
+
+// structOf returns struct type described by value or type
+func structOf(v interface{}) (reflect.Type, error) {
+	typ, ok := v.(reflect.Type)
+	if !ok {
+		typ = reflect.TypeOf(v)
+	}
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%v is not a struct", typ)
+	}
+
+	return typ, nil
+}
+
+// Sizeof returns size of C structure described by Go struct (value, pointer or reflect.Type)
+func Sizeof(v interface{}) (uintptr, error) {
+	typ, err := structOf(v)
+	if err != nil {
+		return 0, fmt.Errorf("sizeof: %w", err)
+	}
+
+	l, err := layoutOf(typ)
+	if err != nil {
+		return 0, fmt.Errorf("sizeof: %w", err)
+	}
+
+	return l.size, nil
+}
+
+// Alignof returns alignment of C structure described by Go struct
+func Alignof(v interface{}) (uintptr, error) {
+	typ, err := structOf(v)
+	if err != nil {
+		return 0, fmt.Errorf("alignof: %w", err)
+	}
+
+	l, err := layoutOf(typ)
+	if err != nil {
+		return 0, fmt.Errorf("alignof: %w", err)
+	}
+
+	return l.align, nil
+}
+
+// Offsetof returns offset of field in C structure described by Go struct.
+// Fields of nested structs are addressed by path, like "Header.Size".
+func Offsetof(v interface{}, field string) (uintptr, error) {
+	typ, err := structOf(v)
+	if err != nil {
+		return 0, fmt.Errorf("offsetof: %w", err)
+	}
+
+	l, err := layoutOf(typ)
+	if err != nil {
+		return 0, fmt.Errorf("offsetof: %w", err)
+	}
+
+	var offset uintptr
+	path := strings.Split(field, ".")
+	for ii, name := range path {
+		f := l.field(name)
+		if f == nil {
+			return 0, fmt.Errorf("offsetof: field %q not found in %s", name, l.typ)
+		}
+		offset += f.offset
+		if ii == len(path)-1 {
+			break
+		}
+		if f.kind != fieldStruct {
+			return 0, fmt.Errorf("offsetof: field %q is not a struct", name)
+		}
+		l = f.layout
+	}
+
+	return offset, nil
+}
+
+func (l *layout) field(name string) *cfield {
+	for _, f := range l.fields {
+		if f.name == name {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// Marshal copies Go struct (value or pointer) into C memory.
+// Memory must have at least Sizeof bytes.
+func Marshal(dst unsafe.Pointer, v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return errors.New("marshal: nil pointer")
+		}
+		val = val.Elem()
+	} else {
+		// Make value addressable
+		tmp := reflect.New(val.Type()).Elem()
+		tmp.Set(val)
+		val = tmp
+	}
+
+	l, err := layoutOf(val.Type())
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	l.store(dst, val)
+	return nil
+}
+
+// Unmarshal copies C memory into Go struct referenced by pointer v
+func Unmarshal(src unsafe.Pointer, v interface{}) error {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return fmt.Errorf("unmarshal: pointer to struct required, not %T", v)
+	}
+
+	l, err := layoutOf(val.Type().Elem())
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	l.load(src, val.Elem())
+	return nil
+}
+
+// bufferOf returns Go memory referenced by slice or pointer value
+func bufferOf(v reflect.Value) []byte {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return unsafe.Slice((*byte)(unsafe.Pointer(v.Pointer())), v.Type().Elem().Size())
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		return unsafe.Slice((*byte)(unsafe.Pointer(v.Pointer())), uintptr(v.Len())*v.Type().Elem().Size())
+	}
+
+	return nil
+}
+
+// marshaled is a C copy of Go structs referenced by pointer or slice value
+type marshaled struct {
+	value  reflect.Value
+	layout *layout
+	buffer []byte
+}
+
+// marshalValue returns C copy of structs referenced by v,
+// when their layout doesn't allow to pass them in place.
+// Result is nil, when value might be passed in place.
+func marshalValue(v reflect.Value, alloc func(size uintptr) unsafe.Pointer) (*marshaled, error) {
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Slice {
+		return nil, nil
+	}
+
+	typ := v.Type().Elem()
+	if typ.Kind() != reflect.Struct || v.Kind() == reflect.Ptr && v.IsNil() || v.Kind() == reflect.Slice && v.Len() == 0 {
+		return nil, nil
+	}
+
+	l, err := layoutOf(typ)
+	if err != nil {
+		return nil, err
+	}
+	if l.inplace {
+		return nil, nil
+	}
+
+	count := 1
+	if v.Kind() == reflect.Slice {
+		count = v.Len()
+	}
+	size := l.size * uintptr(count)
+	if size == 0 {
+		return nil, nil
+	}
+
+	m := &marshaled{
+		value:  v,
+		layout: l,
+		buffer: unsafe.Slice((*byte)(alloc(size)), size),
+	}
+	m.each(l.store)
+
+	return m, nil
+}
+
+// unmarshal copies C copy back into Go structs
+func (m *marshaled) unmarshal() {
+	m.each(m.layout.load)
+}
+
+func (m *marshaled) each(fn func(unsafe.Pointer, reflect.Value)) {
+	base := unsafe.Pointer(&m.buffer[0])
+	if m.value.Kind() == reflect.Ptr {
+		fn(base, m.value.Elem())
+		return
+	}
+
+	for ii := 0; ii < m.value.Len(); ii++ {
+		fn(unsafe.Add(base, uintptr(ii)*m.layout.size), m.value.Index(ii))
+	}
+}
@@ -0,0 +1,162 @@
+package dl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"unsafe"
+)
+
+type testHeader struct {
+	Tag  uint8
+	Size uint32
+}
+
+type testPacket struct {
+	_       struct{} `dl:"pack=1"`
+	Kind    uint8
+	Length  uint16
+	Header  testHeader
+	Payload [3]int16
+	Name    string `dl:"char[5]"`
+	Data    unsafe.Pointer
+}
+
+func TestLayout(t *testing.T) {
+	size, err := Sizeof(testHeader{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(8), size)
+
+	size, err = Sizeof(&testPacket{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(1+2+8+6+5+8), size)
+
+	align, err := Alignof(testPacket{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(1), align)
+
+	offset, err := Offsetof(testPacket{}, "Header.Size")
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(3+4), offset)
+
+	offset, err = Offsetof(testPacket{}, "Name")
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(17), offset)
+
+	_, err = Offsetof(testPacket{}, "Unknown")
+	require.Error(t, err)
+
+	_, err = Sizeof(struct{ Name string }{})
+	require.Error(t, err)
+}
+
+func TestMarshal(t *testing.T) {
+	src := testPacket{
+		Kind:    1,
+		Length:  0x0203,
+		Header:  testHeader{Tag: 4, Size: 5},
+		Payload: [3]int16{6, 7, 8},
+		Name:    "overflow",
+	}
+
+	m, err := Alloc(28)
+	require.NoError(t, err)
+	defer m.Free()
+
+	require.NoError(t, Marshal(m.Pointer(), src))
+	assert.Equal(t, []byte{1, 3, 2, 4}, m.Bytes()[:4])
+	assert.Equal(t, "over\x00", string(m.Bytes()[17:22]))
+
+	var dst testPacket
+	require.NoError(t, Unmarshal(m.Pointer(), &dst))
+	src.Name = "over"
+	assert.Equal(t, src, dst)
+}
+
+// Expected values are produced by GCC on x86-64
+
+type testBits struct {
+	A uint32 `dl:"bits=3"`
+	B uint32 `dl:"bits=30"`
+	C uint8
+}
+
+type testMixedBits struct {
+	X uint8  `dl:"bits=4"`
+	Y uint16 `dl:"bits=10"`
+	Z int32  `dl:"bits=5"`
+}
+
+type testPackedBits struct {
+	_ struct{} `dl:"pack=1"`
+	A uint8    `dl:"bits=3"`
+	B uint32   `dl:"bits=31"`
+}
+
+type testUnion struct {
+	_ struct{} `dl:"union"`
+	I int32
+	D float64
+	S string `dl:"char[12]"`
+}
+
+type testTagged struct {
+	Tag   int8
+	Value testUnion
+}
+
+func TestBitfields(t *testing.T) {
+	size, err := Sizeof(testBits{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(12), size)
+	offset, err := Offsetof(testBits{}, "C")
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(8), offset)
+
+	buf := make([]byte, size)
+	require.NoError(t, Marshal(unsafe.Pointer(&buf[0]), testBits{A: 5, B: 0x2AAAAAAA, C: 7}))
+	assert.Equal(t, []byte{0x05, 0, 0, 0, 0xaa, 0xaa, 0xaa, 0x2a, 0x07, 0, 0, 0}, buf)
+
+	size, err = Sizeof(testMixedBits{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(4), size)
+
+	buf = make([]byte, size)
+	src := testMixedBits{X: 9, Y: 1000, Z: -3}
+	require.NoError(t, Marshal(unsafe.Pointer(&buf[0]), src))
+	assert.Equal(t, []byte{0x89, 0x7e, 0x07, 0x00}, buf)
+
+	var dst testMixedBits
+	require.NoError(t, Unmarshal(unsafe.Pointer(&buf[0]), &dst))
+	assert.Equal(t, src, dst)
+
+	size, err = Sizeof(testPackedBits{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(5), size)
+
+	_, err = Sizeof(struct {
+		A uint8 `dl:"bits=9"`
+	}{})
+	require.Error(t, err)
+}
+
+func TestUnion(t *testing.T) {
+	size, err := Sizeof(testUnion{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(16), size)
+
+	size, err = Sizeof(testTagged{})
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(24), size)
+	offset, err := Offsetof(testTagged{}, "Value")
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(8), offset)
+
+	buf := make([]byte, size)
+	require.NoError(t, Marshal(unsafe.Pointer(&buf[0]), testTagged{Tag: 1, Value: testUnion{S: "abc"}}))
+
+	var dst testTagged
+	require.NoError(t, Unmarshal(unsafe.Pointer(&buf[0]), &dst))
+	assert.Equal(t, "abc", dst.Value.S)
+	assert.Equal(t, int32(0x636261), dst.Value.I)
+}
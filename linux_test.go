@@ -3,18 +3,35 @@
 package dl
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"runtime/pprof"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestCall(t *testing.T) {
 	lib, err := Open("libc", 0)
 	require.NoError(t, err)
-	defer Close()
+	defer lib.Close()
 
-	err = Define(&Routine{
+	err = lib.Define(&Routine{
 		Name:   "strlen",
 		Result: &Arg{Type: reflect.Int},
 		Args: []*Arg{
@@ -23,8 +40,1067 @@ func TestCall(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	l, err := Call("strlen", "this")
+	l, err := lib.Call("strlen", "this")
 	require.NoError(t, err)
 
 	assert.Equal(t, int(4), l.(int))
 }
+
+func TestCallOwnedResult(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	err = lib.Define(&Routine{
+		Name:   "strdup",
+		Result: &Arg{Type: reflect.String, Ownership: OwnedFree},
+		Args: []*Arg{
+			{Type: reflect.String},
+		},
+	})
+	require.NoError(t, err)
+
+	s, err := lib.Call("strdup", "copy")
+	require.NoError(t, err)
+	assert.Equal(t, "copy", s.(string))
+
+	var strdup func(string) string
+	err = lib.Symbol("strdup", &strdup)
+	require.NoError(t, err)
+	assert.Equal(t, "bound", strdup("bound"))
+
+	// Owned memory would be released before the caller gets it
+	var strdupPtr func(string) unsafe.Pointer
+	err = lib.Symbol("strdup", &strdupPtr)
+	assert.Error(t, err)
+
+	err = lib.Define(&Routine{
+		Name:   "strndup",
+		Result: &Arg{Type: reflect.String, Ownership: OwnedDeallocator, Deallocator: "free"},
+		Args: []*Arg{
+			{Type: reflect.String},
+			{Type: reflect.Uint},
+		},
+	})
+	require.NoError(t, err)
+
+	s, err = lib.Call("strndup", "truncated", 5)
+	require.NoError(t, err)
+	assert.Equal(t, "trunc", s.(string))
+}
+
+func TestDefineOwnershipOfPointer(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	err = lib.Define(&Routine{
+		Name:   "malloc",
+		Result: &Arg{Type: reflect.UnsafePointer, Ownership: OwnedFree},
+		Args: []*Arg{
+			{Type: reflect.Uint},
+		},
+	})
+	require.Error(t, err)
+}
+
+func TestCallMemory(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	err = lib.Define(&Routine{
+		Name:   "strlen",
+		Result: &Arg{Type: reflect.Int},
+		Args: []*Arg{
+			{Type: reflect.UnsafePointer},
+		},
+	})
+	require.NoError(t, err)
+
+	s := CopyString("memory")
+	defer s.Free()
+
+	l, err := lib.Call("strlen", s)
+	require.NoError(t, err)
+	assert.Equal(t, 6, l.(int))
+}
+
+func TestCgoCheck(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	type Holder struct {
+		Name [8]byte
+		Next *int
+	}
+
+	var strlen func(*Holder) int
+	err = lib.Symbol("strlen", &strlen)
+	require.NoError(t, err)
+
+	SetCgoCheck(true)
+	defer SetCgoCheck(false)
+
+	h := &Holder{Name: [8]byte{'g', 'o'}}
+	assert.Equal(t, 2, strlen(h))
+
+	h.Next = new(int)
+	assert.Panics(t, func() { strlen(h) })
+}
+
+func TestCallRetained(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var strlen func(...interface{}) int
+	err = lib.Symbol("strlen", &strlen)
+	require.NoError(t, err)
+
+	buf := []byte("retained\x00")
+	assert.Equal(t, 8, strlen(Retain(buf)))
+}
+
+func TestSanitizer(t *testing.T) {
+	lib, err := Open("libc", 0, WithSanitizer())
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var memset func([]byte, int, uint) uintptr
+	err = lib.Symbol("memset", &memset)
+	require.NoError(t, err)
+
+	buf := make([]byte, 8)
+	memset(buf, 'x', 8)
+	assert.Equal(t, []byte("xxxxxxxx"), buf)
+
+	err = lib.Define(&Routine{
+		Name: "memset",
+		Args: []*Arg{
+			{Type: reflect.Uint8, Pointer: true},
+			{Type: reflect.Int},
+			{Type: reflect.Uint},
+		},
+	})
+	require.NoError(t, err)
+
+	var b uint8
+	_, err = lib.Call("memset", &b, 'y', 4)
+	var overflow *OverflowError
+	require.ErrorAs(t, err, &overflow)
+	assert.Equal(t, 0, overflow.Index)
+	assert.Equal(t, 1, overflow.Offset)
+	assert.False(t, overflow.Fault)
+
+	_, err = lib.Call("memset", &b, 'z', 8192)
+	require.ErrorAs(t, err, &overflow)
+	assert.True(t, overflow.Fault)
+	assert.NotZero(t, overflow.PC)
+	assert.Contains(t, overflow.Location, "libc.so.6")
+
+	// Go runtime still handles its own faults
+	assert.Panics(t, func() {
+		var p *int
+		_ = *p
+	})
+}
+
+func TestCallStruct(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	type Packed struct {
+		_ struct{} `dl:"pack=1"`
+		A uint8
+		B uint32
+	}
+
+	err = lib.Define(&Routine{
+		Name: "memset",
+		Args: []*Arg{
+			{Type: reflect.Struct, Pointer: true, Struct: reflect.TypeOf(Packed{})},
+			{Type: reflect.Int},
+			{Type: reflect.Uint},
+		},
+	})
+	require.NoError(t, err)
+
+	var p Packed
+	_, err = lib.Call("memset", &p, 1, 5)
+	require.NoError(t, err)
+	assert.Equal(t, Packed{A: 1, B: 0x01010101}, p)
+
+	type Tm struct {
+		Sec, Min, Hour, Mday, Mon, Year, Wday, Yday, Isdst int32
+		Gmtoff                                             int64
+		Zone                                               unsafe.Pointer
+	}
+
+	err = lib.Define(&Routine{
+		Name:   "gmtime",
+		Result: &Arg{Type: reflect.Struct, Pointer: true, Struct: reflect.TypeOf(Tm{})},
+		Args: []*Arg{
+			{Type: reflect.Int64, Pointer: true},
+		},
+	})
+	require.NoError(t, err)
+
+	ts := int64(86400 + 3600)
+	res, err := lib.Call("gmtime", &ts)
+	require.NoError(t, err)
+	tm := res.(*Tm)
+	assert.Equal(t, int32(2), tm.Mday)
+	assert.Equal(t, int32(1), tm.Hour)
+	assert.Equal(t, int32(70), tm.Year)
+
+	// Targets of pointer fields are pinned during the call
+	type Iovec struct {
+		Base *byte
+		Len  uint64
+	}
+
+	err = lib.Define(&Routine{
+		Name:   "writev",
+		Result: &Arg{Type: reflect.Int64},
+		Args: []*Arg{
+			{Type: reflect.Int},
+			{Type: reflect.Struct, Pointer: true, Struct: reflect.TypeOf(Iovec{})},
+			{Type: reflect.Int},
+		},
+	})
+	require.NoError(t, err)
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	head, tail := []byte("hello, "), []byte("world")
+	iov := []Iovec{
+		{Base: &head[0], Len: uint64(len(head))},
+		{Base: &tail[0], Len: uint64(len(tail))},
+	}
+	res, err = lib.Call("writev", int(w.Fd()), iov, len(iov))
+	require.NoError(t, err)
+	assert.Equal(t, int64(12), res)
+
+	buf := make([]byte, 12)
+	_, err = io.ReadFull(r, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello, world", string(buf))
+}
+
+func TestExports(t *testing.T) {
+	path, err := Find("libc")
+	require.NoError(t, err)
+
+	exports, err := Exports(path)
+	require.NoError(t, err)
+
+	found := false
+	for _, e := range exports {
+		if e.Name == "abs" {
+			found = true
+			assert.Equal(t, "func", e.Type)
+		}
+	}
+	assert.True(t, found)
+
+	needed, err := Needed(path)
+	require.NoError(t, err)
+	assert.NotEmpty(t, needed)
+}
+
+// buildLibrary compiles C source into shared library with debug info
+func buildLibrary(t *testing.T, source string) string {
+	gcc, err := exec.LookPath("gcc")
+	if err != nil {
+		t.Skip("gcc not found")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "test.c")
+	require.NoError(t, os.WriteFile(src, []byte(source), 0644))
+	path := filepath.Join(dir, "libtest.so")
+	out, err := exec.Command(gcc, "-g", "-shared", "-fPIC", "-o", path, src).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	return path
+}
+
+func TestVerify(t *testing.T) {
+	path := buildLibrary(t, `
+struct point { int x; int y; };
+long add(long a, long b) { return a + b; }
+double scale(struct point *p, double k) { return (p->x + p->y) * k; }
+void reset(char *s) { s[0] = 0; }
+`)
+
+	type point struct {
+		X, Y int32
+	}
+	type wide struct {
+		X int64
+	}
+	lib, err := Open(path, 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "add",
+		Result: &Arg{Type: reflect.Int64},
+		Args:   []*Arg{{Type: reflect.Int64}, {Type: reflect.Int64}},
+	}))
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "scale",
+		Result: &Arg{Type: reflect.Float64},
+		Args:   []*Arg{{Type: reflect.Struct, Pointer: true, Struct: reflect.TypeOf(point{})}, {Type: reflect.Float64}},
+	}))
+	require.NoError(t, lib.Define(&Routine{
+		Name: "reset",
+		Args: []*Arg{{Type: reflect.String}},
+	}))
+	assert.NoError(t, lib.Verify())
+
+	mismatches, err := VerifyRoutines(path,
+		&Routine{
+			Name:   "add",
+			Result: &Arg{Type: reflect.Int32},
+			Args:   []*Arg{{Type: reflect.Uint64}},
+		},
+		&Routine{
+			Name:   "scale",
+			Result: &Arg{Type: reflect.Float64},
+			Args:   []*Arg{{Type: reflect.Struct, Pointer: true, Struct: reflect.TypeOf(wide{})}, {Type: reflect.Float32}},
+		},
+		&Routine{Name: "missing"},
+	)
+	require.NoError(t, err)
+
+	var got []string
+	for _, m := range mismatches {
+		got = append(got, m.String())
+	}
+	assert.Equal(t, []string{
+		"add: want 2 arguments (long int add(long int, long int)), got 1",
+		"add: argument 0: want long int, got uint64 (signedness differs)",
+		"add: result: want long int, got int32 (size 8 expected)",
+		"scale: argument 0: want struct point *, got struct wide * (dl.wide has 1 fields, want 2)",
+		"scale: argument 1: want double, got float32 (floating point expected)",
+		"missing: no debug info for routine",
+	}, got)
+}
+
+func TestGenerateRoutines(t *testing.T) {
+	path := buildLibrary(t, `
+struct point { char tag; int x; short y; unsigned flag : 1; };
+struct handle;
+long add(long a, long b) { return a + b; }
+int sum(struct point *p) { return p->x + p->y + p->flag; }
+struct handle *get(const char *name) { return 0; }
+void fill(char *buf) { buf[0] = 0; }
+int cmp(const struct point *a, const struct point *b) { return a->x - b->x; }
+int printf_like(const char *fmt, ...) { return 0; }
+`)
+
+	routines, err := GenerateRoutines(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "printf_like: variadic functions are not supported")
+
+	var defs []string
+	byName := make(map[string]*Routine)
+	for _, routine := range routines {
+		def, err := FormatRoutine(routine)
+		require.NoError(t, err)
+		defs = append(defs, def)
+		byName[routine.Name] = routine
+
+		parsed, err := ParseRoutineDefinition(def)
+		require.NoError(t, err)
+		assert.Equal(t, routine.Name, parsed.Name)
+	}
+	assert.Equal(t, []string{
+		"int64 add(int64, int64)",
+		"int32 cmp(struct *, struct *)",
+		"void fill(uint8 *)",
+		"void *get(string)",
+		"int32 sum(struct *)",
+	}, defs)
+
+	// The same struct becomes one Go type
+	assert.Equal(t, byName["sum"].Args[0].Struct, byName["cmp"].Args[0].Struct)
+	assert.Equal(t, byName["sum"].Args[0].Struct, byName["cmp"].Args[1].Struct)
+
+	typ := byName["sum"].Args[0].Struct
+	require.NotNil(t, typ)
+	size, err := Sizeof(typ)
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(12), size)
+
+	lib, err := Open(path, 0)
+	require.NoError(t, err)
+	defer lib.Close()
+	require.NoError(t, lib.Define(byName["sum"]))
+
+	p := reflect.New(typ)
+	p.Elem().FieldByName("X").SetInt(40)
+	p.Elem().FieldByName("Y").SetInt(1)
+	p.Elem().FieldByName("Flag").SetUint(1)
+	res, err := lib.Call("sum", p.Interface())
+	require.NoError(t, err)
+	assert.Equal(t, int32(42), res)
+}
+
+func TestDiffABI(t *testing.T) {
+	oldPath := buildLibrary(t, `
+struct point { int x; int y; };
+int area(struct point *p) { return p->x * p->y; }
+long add(long a, long b) { return a + b; }
+int gone(void) { return 0; }
+int stable(int a) { return a; }
+`)
+	newPath := buildLibrary(t, `
+struct point { int x; long y; };
+int area(struct point *p) { return p->x * p->y; }
+long add(long a, long b, long c) { return a + b + c; }
+int stable(int a) { return a; }
+int fresh(void) { return 0; }
+`)
+
+	diff, err := DiffABI(oldPath, newPath,
+		&Routine{Name: "add"},
+		&Routine{Name: "gone"},
+		&Routine{Name: "stable"},
+	)
+	require.NoError(t, err)
+	assert.True(t, diff.Prototypes)
+
+	var got []string
+	for _, c := range diff.Changes {
+		got = append(got, fmt.Sprintf("%v %s", c.Breaking, c))
+	}
+	assert.Equal(t, []string{
+		"true add: proto: long int add(long int, long int) => long int add(long int, long int, long int)",
+		"true gone: removed: func",
+		"false area: layout: struct point {int x@0; int y@4} size 8 => struct point {int x@0; long int y@8} size 16",
+		"false fresh: added: func",
+	}, got)
+	assert.Len(t, diff.Breaking(), 2)
+
+	_, err = DiffABI(oldPath, newPath, &Routine{Name: "add"}, nil)
+	assert.Error(t, err)
+}
+
+func TestOpenMissingDependency(t *testing.T) {
+	base := buildLibrary(t, `int base(void) { return 1; }`)
+	dir := t.TempDir()
+	dep := filepath.Join(dir, "libbase.so")
+	require.NoError(t, os.Rename(base, dep))
+
+	src := filepath.Join(dir, "top.c")
+	require.NoError(t, os.WriteFile(src, []byte(`int base(void); int top(void) { return base(); }`), 0644))
+	path := filepath.Join(dir, "libtop.so")
+	out, err := exec.Command("gcc", "-shared", "-fPIC", "-o", path, src, "-L"+dir, "-lbase", "-Wl,-rpath,$ORIGIN").CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	obj, deps, err := Resolve(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"$ORIGIN"}, append(obj.RPath, obj.RunPath...))
+	require.NotEmpty(t, deps)
+	assert.Equal(t, "libbase.so", deps[0].Name)
+	require.NotNil(t, deps[0].Object)
+	assert.Equal(t, dep, deps[0].Object.Path)
+
+	require.NoError(t, os.Remove(dep))
+	_, err = Open(path, 0)
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrLibraryNotFound)
+	assert.NotErrorIs(t, err, ErrIncompatibleLibrary)
+	var loadErr *LoadError
+	require.ErrorAs(t, err, &loadErr)
+	require.Len(t, loadErr.Problems, 1)
+	assert.Equal(t, "libbase.so", loadErr.Problems[0].Name)
+	assert.Equal(t, "not found", loadErr.Problems[0].Error)
+	assert.Equal(t, dir, loadErr.Problems[0].Searched[0])
+}
+
+func TestInfo(t *testing.T) {
+	lib, err := Open("libc", RTLD_LAZY)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	info, err := lib.Info()
+	require.NoError(t, err)
+	assert.True(t, filepath.IsAbs(info.Path))
+	assert.Equal(t, "libc.so.6", info.SOName)
+	assert.NotZero(t, info.Base)
+	assert.Equal(t, RTLD_LAZY, info.Flags)
+
+	found := false
+	for _, l := range info.LinkMap {
+		found = found || l.Path == info.Path && l.Base == info.Base
+	}
+	assert.True(t, found)
+	// libc and the dynamic loader it needs, not the test binary
+	assert.Len(t, info.LinkMap, 2)
+
+	id, err := BuildID(info.Path)
+	require.NoError(t, err)
+	assert.Equal(t, id, info.BuildID)
+}
+
+func TestAddr(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var abs unsafe.Pointer
+	require.NoError(t, lib.Symbol("abs", &abs))
+	info, err := lib.Info()
+	require.NoError(t, err)
+
+	loc, err := Addr(abs)
+	require.NoError(t, err)
+	assert.Equal(t, "abs", loc.Symbol)
+	assert.Equal(t, uintptr(abs), loc.SymbolAddr)
+	assert.Equal(t, info.Base, loc.Base)
+	assert.Zero(t, loc.Offset)
+
+	loc, err = Addr(uintptr(abs) + 4)
+	require.NoError(t, err)
+	assert.Equal(t, "libc.so.6!abs+0x4", loc.String())
+
+	_, err = Addr(uintptr(0))
+	assert.Error(t, err)
+}
+
+func TestReadMemory(t *testing.T) {
+	m, err := Alloc(4)
+	require.NoError(t, err)
+	defer m.Free()
+	copy(m.Bytes(), "abcd")
+
+	data, err := ReadMemory(uintptr(m.Pointer()), 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), data)
+
+	_, err = ReadMemory(0x10, 4)
+	assert.ErrorContains(t, err, "is not mapped")
+	_, err = ReadMemory(^uintptr(0), 2)
+	assert.Error(t, err)
+}
+
+func TestBind(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var abs unsafe.Pointer
+	require.NoError(t, lib.Symbol("abs", &abs))
+
+	fn, err := Bind(uintptr(abs), &Routine{
+		Name:   "abs",
+		Result: &Arg{Type: reflect.Int32},
+		Args:   []*Arg{{Type: reflect.Int32}},
+	}, WithCodeCheck())
+	require.NoError(t, err)
+	defer fn.Close()
+
+	res, err := fn.Call(-5)
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), res)
+
+	var f func(int32) int32
+	require.NoError(t, fn.Func(&f))
+	assert.Equal(t, int32(7), f(-7))
+
+	var data [16]byte
+	_, err = Bind(uintptr(unsafe.Pointer(&data[0])), &Routine{Name: "data"}, WithCodeCheck())
+	assert.Error(t, err)
+	_, err = Bind(0, &Routine{Name: "null"})
+	assert.Error(t, err)
+}
+
+func TestBindTable(t *testing.T) {
+	path := buildLibrary(t, `
+struct api { int (*add)(void *ctx, int v); void *reserved; int (*get)(void *ctx); void (*none)(void); };
+static int add(void *ctx, int v) { return *(int *)ctx += v; }
+static int get(void *ctx) { return *(int *)ctx; }
+static struct api api = {add, (void *)42, get, 0};
+struct api *plugin_api(void) { return &api; }
+
+struct obj;
+struct vtable { int (*get)(struct obj *); void (*set)(struct obj *, int); int (*twice)(int); };
+struct obj { const struct vtable *vt; int value; };
+static int obj_get(struct obj *o) { return o->value; }
+static void obj_set(struct obj *o, int v) { o->value = v; }
+static int twice(int v) { return v * 2; }
+static const struct vtable vt = {obj_get, obj_set, twice};
+static struct obj o = {&vt, 1};
+struct obj *new_obj(void) { return &o; }
+`)
+
+	lib, err := Open(path, 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var pluginAPI, newObj func() uintptr
+	require.NoError(t, lib.Symbol("plugin_api", &pluginAPI))
+	require.NoError(t, lib.Symbol("new_obj", &newObj))
+
+	ctx, err := Alloc(4)
+	require.NoError(t, err)
+	defer ctx.Free()
+
+	var api struct {
+		Add      func(int32) int32
+		Reserved uintptr
+		Get      func() int32
+		None     func()
+	}
+	table, err := BindTable(pluginAPI(), uintptr(ctx.Pointer()), &api, WithCodeCheck())
+	require.NoError(t, err)
+	defer table.Close()
+
+	assert.Equal(t, int32(3), api.Add(3))
+	assert.Equal(t, int32(5), api.Add(2))
+	assert.Equal(t, int32(5), api.Get())
+	assert.Equal(t, uintptr(42), api.Reserved)
+	assert.Nil(t, api.None)
+
+	var obj struct {
+		Get   func() int32
+		Set   func(int32)
+		Twice func(int32) int32 `dl:"static"`
+	}
+	table, err = BindObject(newObj(), &obj)
+	require.NoError(t, err)
+	defer table.Close()
+
+	assert.Equal(t, int32(1), obj.Get())
+	obj.Set(21)
+	assert.Equal(t, int32(21), obj.Get())
+	assert.Equal(t, int32(42), obj.Twice(obj.Get()))
+
+	// Interfaces can't be implemented by reflection
+	var getter interface{ Get() int32 }
+	_, err = BindObject(newObj(), &getter)
+	assert.Error(t, err)
+	var iface struct{ Get interface{} }
+	_, err = BindObject(newObj(), &iface)
+	assert.Error(t, err)
+}
+
+func TestHandle(t *testing.T) {
+	path := buildLibrary(t, `void *echo(void *p) { return p; }`)
+	lib, err := Open(path, 0)
+	require.NoError(t, err)
+
+	var echo func(Handle) uintptr
+	require.NoError(t, lib.Symbol("echo", &echo))
+
+	type state struct{ calls int }
+	h := lib.NewHandle(&state{calls: 1})
+	back, err := HandleOf(echo(h))
+	require.NoError(t, err)
+	v, err := back.Value()
+	require.NoError(t, err)
+	assert.Equal(t, 1, v.(*state).calls)
+
+	// Call passes handle as integer, even when conversion is strict
+	strict, err := Open(path, 0, WithConversion(ConvertStrict))
+	require.NoError(t, err)
+	defer strict.Close()
+	require.NoError(t, strict.Define(&Routine{
+		Name:   "echo",
+		Result: &Arg{Type: reflect.Uintptr},
+		Args:   []*Arg{{Type: reflect.UnsafePointer}},
+	}))
+	res, err := strict.Call("echo", h)
+	require.NoError(t, err)
+	assert.Equal(t, uintptr(h), res)
+
+	free := NewHandle("free")
+	require.NoError(t, free.Delete())
+	_, err = free.Value()
+	assert.ErrorIs(t, err, ErrStaleHandle)
+	assert.ErrorIs(t, free.Delete(), ErrStaleHandle)
+
+	// Slot is reused with another generation
+	reused := NewHandle("reused")
+	defer reused.Delete()
+	_, err = free.Value()
+	assert.ErrorIs(t, err, ErrStaleHandle)
+
+	_, err = Handle(0).Value()
+	assert.ErrorIs(t, err, ErrInvalidHandle)
+
+	require.NoError(t, lib.Close())
+	_, err = h.Value()
+	assert.ErrorIs(t, err, ErrStaleHandle)
+}
+
+func TestRecordReplay(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+
+	var record bytes.Buffer
+	rec, err := Record(lib, &record)
+	require.NoError(t, err)
+
+	strtol := &Routine{
+		Name:   "strtol",
+		Result: &Arg{Type: reflect.Int64},
+		Args:   []*Arg{{Type: reflect.String}, {Type: reflect.UnsafePointer, Pointer: true}, {Type: reflect.Int32}},
+	}
+	memset := &Routine{
+		Name: "memset",
+		Args: []*Arg{{Type: reflect.Uint8, Pointer: true}, {Type: reflect.Int32}, {Type: reflect.Uint64}},
+	}
+	require.NoError(t, rec.Define(strtol))
+	require.NoError(t, rec.Define(memset))
+
+	res, err := rec.Call("strtol", "99999999999999999999", nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), res)
+	buf, err := Alloc(4)
+	require.NoError(t, err)
+	defer buf.Free()
+	copy(buf.Bytes(), "abcd")
+	_, err = rec.Call("memset", buf, 'x', 2)
+	require.NoError(t, err)
+	_, err = rec.Call("strtol", "1", nil, "ten")
+	var argErr *ArgumentError
+	require.ErrorAs(t, err, &argErr)
+	require.NoError(t, rec.Close())
+	_, err = rec.Call("strtol", "1", nil, 10)
+	require.ErrorIs(t, err, ErrClosed)
+
+	lines := strings.Split(strings.TrimSpace(record.String()), "\n")
+	require.Len(t, lines, 5)
+	var call RecordedCall
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &call))
+	assert.Equal(t, int(syscall.ERANGE), call.Errno)
+
+	rp, err := Replay(strings.NewReader(record.String()))
+	require.NoError(t, err)
+	defer rp.Close()
+	assert.Error(t, rp.Define(nil))
+	require.NoError(t, rp.Define(strtol))
+	require.NoError(t, rp.Define(memset))
+
+	res, errno, err := CallErrno(rp, "strtol", "99999999999999999999", nil, 10)
+	require.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), res)
+	assert.Equal(t, syscall.ERANGE, errno)
+	assert.Error(t, rp.Done())
+
+	other, err := Alloc(4)
+	require.NoError(t, err)
+	defer other.Free()
+	copy(other.Bytes(), "abcd")
+	_, err = rp.Call("memset", other, 'y', 2)
+	var divergence *DivergenceError
+	require.ErrorAs(t, err, &divergence)
+	assert.Equal(t, 2, divergence.Seq)
+
+	_, err = rp.Call("memset", other, 'x', 2)
+	require.NoError(t, err)
+	assert.Equal(t, "xxcd", string(other.Bytes()))
+
+	// Typed errors are replayed
+	_, err = rp.Call("strtol", "1", nil, "ten")
+	var replayedArg *ArgumentError
+	require.ErrorAs(t, err, &replayedArg)
+	assert.Equal(t, argErr.Index, replayedArg.Index)
+	assert.Equal(t, argErr.Error(), replayedArg.Error())
+	_, err = rp.Call("strtol", "1", nil, 10)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.NoError(t, rp.Done())
+
+	require.NoError(t, rp.Close())
+	_, err = rp.Call("strtol", "1", nil, 10)
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// Error matching several sentinels gets the same kind every time
+	for ii := 0; ii < 10; ii++ {
+		kind := recordError(fmt.Errorf("%w: %w", ErrClosed, ErrSymbolNotFound))
+		assert.Equal(t, "symbol_not_found", kind.Kind)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "abs",
+		Result: &Arg{Type: reflect.Int32},
+		Args:   []*Arg{{Type: reflect.Int32}},
+	}))
+
+	var trace []string
+	lib.Use(func(ctx CallInfo, next Invoker) (interface{}, error) {
+		res, err := next(ctx)
+		assert.False(t, ctx.Start.IsZero())
+		assert.True(t, time.Since(ctx.Start) >= 0)
+		trace = append(trace, fmt.Sprintf("%s%v=%v", ctx.Name, ctx.Args, res))
+		return res, err
+	}, func(ctx CallInfo, next Invoker) (interface{}, error) {
+		if ctx.Name == "labs" {
+			return nil, errors.New("labs is denied")
+		}
+		if ctx.Routine != nil && ctx.Args[0] == int32(-1) {
+			// Replace argument
+			ctx.Args = []interface{}{int32(-2)}
+		}
+		return next(ctx)
+	})
+
+	// Arguments are converted before interceptors
+	res, err := lib.Call("abs", -1)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), res)
+
+	var abs func(int32) int32
+	require.NoError(t, lib.Symbol("abs", &abs))
+	assert.Equal(t, int32(3), abs(-3))
+
+	var labs func(int64) int64
+	require.NoError(t, lib.Symbol("labs", &labs))
+	assert.PanicsWithError(t, "labs is denied", func() { labs(-4) })
+
+	assert.Equal(t, []string{"abs[-1]=2", "abs[-3]=3", "labs[-4]=<nil>"}, trace)
+}
+
+func TestStats(t *testing.T) {
+	lib, err := Open("libc", 0, WithExpvar("dl_test_libc"), WithProfileLabels())
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var labels []string
+	lib.Use(func(ctx CallInfo, next Invoker) (interface{}, error) {
+		routine, _ := pprof.Label(ctx.Context, "dl_routine")
+		caller, _ := pprof.Label(ctx.Context, "caller")
+		labels = append(labels, routine+"/"+caller)
+		return next(ctx)
+	})
+
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "abs",
+		Result: &Arg{Type: reflect.Int32},
+		Args:   []*Arg{{Type: reflect.Int32}},
+	}))
+	for ii := 0; ii < 2; ii++ {
+		_, err = lib.Call("abs", -ii)
+		require.NoError(t, err)
+	}
+	ctx := pprof.WithLabels(context.Background(), pprof.Labels("caller", "test"))
+	res, err := CallContext(ctx, lib, "abs", -2)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), res)
+	var labs func(int64) int64
+	require.NoError(t, lib.Symbol("labs", &labs))
+	labs(-1)
+	assert.Equal(t, []string{"abs/", "abs/", "abs/test", "labs/"}, labels)
+
+	stats := lib.Stats()
+	require.Contains(t, stats, "abs")
+	abs := stats["abs"]
+	assert.Equal(t, uint64(3), abs.Calls)
+	assert.Equal(t, uint64(0), abs.Errors)
+	assert.True(t, abs.Max > 0 && abs.Max <= abs.Total)
+	assert.Equal(t, abs.Total/3, abs.Mean())
+	require.Len(t, abs.Histogram, len(LatencyBuckets)+1)
+	var count uint64
+	for _, n := range abs.Histogram {
+		count += n
+	}
+	assert.Equal(t, abs.Calls, count)
+	assert.Equal(t, uint64(1), stats["labs"].Calls)
+
+	published := map[string]RoutineStats{}
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("dl_test_libc").String()), &published))
+	assert.Equal(t, uint64(3), published["abs"].Calls)
+}
+
+func TestHooks(t *testing.T) {
+	var events []Event
+	hook := HookFunc(func(e Event) {
+		events = append(events, e)
+	})
+	var logged bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	remove := AddHook(SlogHook(logger))
+
+	_, err := Open("libmissing", 0, WithHook(hook))
+	require.Error(t, err)
+	require.Len(t, events, 1)
+	assert.Equal(t, EventOpen, events[0].Kind)
+	assert.Equal(t, "libmissing.so", events[0].Library)
+	assert.Equal(t, RTLD_NOW, events[0].Flags)
+	assert.Error(t, events[0].Err)
+
+	events = nil
+	lib, err := Open("libc", RTLD_LAZY, WithHook(hook))
+	require.NoError(t, err)
+	require.NoError(t, lib.Define(&Routine{Name: "abs", Result: &Arg{Type: reflect.Int32}, Args: []*Arg{{Type: reflect.Int32}}}))
+	require.Error(t, lib.Define(&Routine{Name: "missing_routine"}))
+	require.NoError(t, lib.Close())
+	remove()
+	require.NoError(t, lib.Close())
+
+	kinds := make([]EventKind, len(events))
+	for ii, e := range events {
+		kinds[ii] = e.Kind
+	}
+	// libc.so is a linker script, so libc.so.6 is tried next,
+	// but only the attempt, which decides the outcome, is reported
+	assert.Equal(t, []EventKind{EventOpen, EventDefine, EventDefine, EventClose}, kinds)
+	assert.NoError(t, events[0].Err)
+	assert.Equal(t, RTLD_LAZY, events[0].Flags)
+	path := events[0].Library
+	assert.True(t, filepath.IsAbs(path), path)
+	assert.Equal(t, path, events[1].Library)
+	assert.Equal(t, "abs", events[1].Symbol)
+	assert.NoError(t, events[1].Err)
+	assert.Equal(t, "missing_routine", events[2].Symbol)
+	assert.Error(t, events[2].Err)
+	assert.Equal(t, path, events[3].Library)
+
+	output := logged.String()
+	assert.Contains(t, output, `level=ERROR msg="dl: open" library=libmissing.so`)
+	assert.Contains(t, output, `msg="dl: define" library=`+path+` symbol=missing_routine error=`)
+	assert.Contains(t, output, `level=DEBUG msg="dl: open" library=`+path+" flags=1\n")
+	assert.Contains(t, output, `level=DEBUG msg="dl: close" library=`+path+"\n")
+}
+
+func TestErrors(t *testing.T) {
+	_, err := Open("libmissing", 0)
+	assert.ErrorIs(t, err, ErrLibraryNotFound)
+	_, err = Open(filepath.Join(t.TempDir(), "libmissing.so"), 0)
+	assert.ErrorIs(t, err, ErrLibraryNotFound)
+
+	invalid := filepath.Join(t.TempDir(), "libinvalid.so")
+	require.NoError(t, os.WriteFile(invalid, []byte("INPUT(libc.so.6)\n"), 0644))
+	_, err = Open(invalid, 0)
+	assert.ErrorIs(t, err, ErrIncompatibleLibrary)
+	assert.NotErrorIs(t, err, ErrLibraryNotFound)
+	unresolved := buildLibrary(t, `int undefined_routine(void); int top(void) { return undefined_routine(); }`)
+	_, err = Open(unresolved, RTLD_NOW)
+	assert.ErrorIs(t, err, ErrIncompatibleLibrary)
+	assert.NotErrorIs(t, err, ErrLibraryNotFound)
+
+	lib, err := Open("libc", 0)
+	require.NoError(t, err)
+
+	abs := &Routine{Name: "abs", Result: &Arg{Type: reflect.Int32}, Args: []*Arg{{Type: reflect.Int32}}}
+	require.NoError(t, lib.Define(abs))
+	assert.ErrorIs(t, lib.Define(&Routine{Name: "missing_routine"}), ErrSymbolNotFound)
+	var missing func()
+	assert.ErrorIs(t, lib.Symbol("missing_routine", &missing), ErrSymbolNotFound)
+	_, err = lib.Call("labs", 1)
+	assert.ErrorIs(t, err, ErrSymbolNotFound)
+
+	var argErr *ArgumentError
+	_, err = lib.Call("abs", "x")
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, "abs", argErr.Routine)
+	assert.Equal(t, 0, argErr.Index)
+	assert.Equal(t, "int32", argErr.Want)
+	assert.Equal(t, "string", argErr.Got)
+	_, err = lib.Call("abs")
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, -1, argErr.Index)
+
+	require.NoError(t, lib.Close())
+	_, err = lib.Call("abs", 1)
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.ErrorIs(t, lib.Define(abs), ErrClosed)
+	assert.ErrorIs(t, lib.Symbol("abs", &missing), ErrClosed)
+	_, err = lib.Info()
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestDefineValidation(t *testing.T) {
+	path := buildLibrary(t, `
+#include <stdbool.h>
+bool negate(bool v) { return !v; }
+`)
+	lib, err := Open(path, 0)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	var null *Routine
+	assert.Error(t, null.Validate())
+	assert.Error(t, lib.Define(nil))
+	_, err = Bind(1, nil)
+	assert.Error(t, err)
+
+	// Failed definition leaves the library unchanged
+	missing := &Routine{Name: "missing_routine"}
+	require.ErrorIs(t, lib.Define(missing), ErrSymbolNotFound)
+	_, err = lib.Call("missing_routine")
+	assert.ErrorIs(t, err, ErrSymbolNotFound)
+	assert.Error(t, lib.Define(&Routine{Name: "negate", Args: []*Arg{{Type: reflect.Map}}}))
+	_, err = lib.Call("negate", true)
+	assert.ErrorIs(t, err, ErrSymbolNotFound)
+
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "negate",
+		Result: &Arg{Type: reflect.Bool},
+		Args:   []*Arg{{Type: reflect.Bool}},
+	}))
+	res, err := lib.Call("negate", true)
+	require.NoError(t, err)
+	assert.Equal(t, false, res)
+	res, err = lib.Call("negate", false)
+	require.NoError(t, err)
+	assert.Equal(t, true, res)
+
+	var negate func(bool) bool
+	require.NoError(t, lib.Symbol("negate", &negate))
+	assert.True(t, negate(false))
+
+	// Arity is checked
+	var argErr *ArgumentError
+	_, err = lib.Call("negate", true, false)
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, -1, argErr.Index)
+	assert.Equal(t, "2", argErr.Got)
+}
+
+func TestConverters(t *testing.T) {
+	lib, err := Open("libc", 0,
+		WithConversion(ConvertStrict),
+		WithConverter(time.Duration(0), func(v interface{}, arg *Arg) (interface{}, error) {
+			return int32(v.(time.Duration) / time.Second), nil
+		}),
+	)
+	require.NoError(t, err)
+	defer lib.Close()
+
+	require.NoError(t, lib.Define(&Routine{
+		Name:   "abs",
+		Result: &Arg{Type: reflect.Int32},
+		Args:   []*Arg{{Type: reflect.Int32}},
+	}))
+
+	var argErr *ArgumentError
+	_, err = lib.Call("abs", "-5")
+	require.ErrorAs(t, err, &argErr)
+	assert.Equal(t, "string", argErr.Got)
+	_, err = lib.Call("abs", -5)
+	assert.Error(t, err)
+
+	res, err := lib.Call("abs", int32(-5))
+	require.NoError(t, err)
+	assert.Equal(t, int32(5), res)
+	res, err = lib.Call("abs", -7*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int32(7), res)
+}
@@ -0,0 +1,242 @@
+package dl
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// pointer is implemented by values, that might be passed to routines as C pointers
+type pointer interface {
+	Pointer() unsafe.Pointer
+}
+
+// Memory is a block of C memory allocated with malloc
+type Memory struct {
+	mu   sync.Mutex
+	ptr  unsafe.Pointer
+	size uintptr
+}
+
+// Alloc allocates zeroed block of C memory.
+// Block must be released with Free.
+func Alloc(size uintptr) (*Memory, error) {
+	if size == 0 {
+		return nil, errors.New("alloc: size must be positive")
+	}
+
+	ptr := C.calloc(1, C.size_t(size))
+	if ptr == nil {
+		return nil, fmt.Errorf("alloc: out of memory (%d bytes)", size)
+	}
+
+	return &Memory{
+		ptr:  ptr,
+		size: size,
+	}, nil
+}
+
+// AllocManaged allocates zeroed block of C memory, which is
+// released by finalizer, when it was not released by Free.
+func AllocManaged(size uintptr) (*Memory, error) {
+	m, err := Alloc(size)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime.SetFinalizer(m, (*Memory).Free)
+	return m, nil
+}
+
+// Free releases memory block. Repeated calls are ignored.
+func (m *Memory) Free() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ptr != nil {
+		C.free(m.ptr)
+		m.ptr = nil
+		m.size = 0
+		runtime.SetFinalizer(m, nil)
+	}
+}
+
+// Pointer returns address of memory block (nil after Free or for nil Memory)
+func (m *Memory) Pointer() unsafe.Pointer {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.ptr
+}
+
+// Size returns size of memory block in bytes
+func (m *Memory) Size() uintptr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.size
+}
+
+// Bytes returns memory block as byte slice without copying.
+// Slice is valid until Free.
+func (m *Memory) Bytes() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ptr == nil {
+		return nil
+	}
+
+	return unsafe.Slice((*byte)(m.ptr), m.size)
+}
+
+// View is a typed bounds-checked view of C memory
+type View[T any] struct {
+	ptr unsafe.Pointer
+	len int
+}
+
+// MakeView creates view of n elements started at ptr
+func MakeView[T any](ptr unsafe.Pointer, n int) View[T] {
+	if ptr == nil || n < 0 {
+		n = 0
+	}
+
+	return View[T]{ptr: ptr, len: n}
+}
+
+// ViewOf creates view over whole memory block
+func ViewOf[T any](m *Memory) View[T] {
+	var zero T
+	size := unsafe.Sizeof(zero)
+	if size == 0 {
+		return View[T]{}
+	}
+
+	return MakeView[T](m.Pointer(), int(m.Size()/size))
+}
+
+// Len returns count of elements
+func (v View[T]) Len() int {
+	return v.len
+}
+
+// Pointer returns address of the first element
+func (v View[T]) Pointer() unsafe.Pointer {
+	return v.ptr
+}
+
+// Index returns copy of element at index i
+func (v View[T]) Index(i int) (T, error) {
+	p, err := v.at(i)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return *p, nil
+}
+
+// Set stores value at index i
+func (v View[T]) Set(i int, value T) error {
+	p, err := v.at(i)
+	if err != nil {
+		return err
+	}
+
+	*p = value
+	return nil
+}
+
+// Slice returns view of elements [lo, hi)
+func (v View[T]) Slice(lo, hi int) (View[T], error) {
+	if lo < 0 || hi < lo || hi > v.len {
+		return View[T]{}, fmt.Errorf("view: slice bounds [%d:%d] out of range with length %d", lo, hi, v.len)
+	}
+
+	if lo == hi {
+		return View[T]{}, nil
+	}
+
+	p, _ := v.at(lo)
+	return View[T]{ptr: unsafe.Pointer(p), len: hi - lo}, nil
+}
+
+// Copy copies elements into dst and returns count of copied elements
+func (v View[T]) Copy(dst []T) int {
+	return copy(dst, v.slice())
+}
+
+// CopyFrom copies elements from src into view and returns count of copied elements
+func (v View[T]) CopyFrom(src []T) int {
+	return copy(v.slice(), src)
+}
+
+func (v View[T]) at(i int) (*T, error) {
+	if i < 0 || i >= v.len {
+		return nil, fmt.Errorf("view: index %d out of range with length %d", i, v.len)
+	}
+
+	var zero T
+	return (*T)(unsafe.Add(v.ptr, uintptr(i)*unsafe.Sizeof(zero))), nil
+}
+
+func (v View[T]) slice() []T {
+	if v.len == 0 {
+		return nil
+	}
+
+	return unsafe.Slice((*T)(v.ptr), v.len)
+}
+
+// CopyIn allocates C memory and copies data into it
+func CopyIn[T any](data []T) (*Memory, error) {
+	var zero T
+	size := uintptr(len(data)) * unsafe.Sizeof(zero)
+	if size == 0 {
+		return nil, errors.New("copy in: empty data")
+	}
+
+	m, err := Alloc(size)
+	if err != nil {
+		return nil, fmt.Errorf("copy in: %w", err)
+	}
+
+	ViewOf[T](m).CopyFrom(data)
+	return m, nil
+}
+
+// CopyOut copies n elements started at ptr into Go memory
+func CopyOut[T any](ptr unsafe.Pointer, n int) []T {
+	v := MakeView[T](ptr, n)
+	res := make([]T, v.Len())
+	v.Copy(res)
+	return res
+}
+
+// CopyString allocates C string, which is a copy of s
+func CopyString(s string) *Memory {
+	return &Memory{
+		ptr:  unsafe.Pointer(C.CString(s)),
+		size: uintptr(len(s) + 1),
+	}
+}
+
+// GoString copies C string into Go memory
+func GoString(ptr unsafe.Pointer) string {
+	if ptr == nil {
+		return ""
+	}
+
+	return C.GoString((*C.char)(ptr))
+}
@@ -0,0 +1,51 @@
+package dl
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestView(t *testing.T) {
+	m, err := CopyIn([]int32{1, 2, 3, 4})
+	require.NoError(t, err)
+	defer m.Free()
+
+	v := ViewOf[int32](m)
+	require.Equal(t, 4, v.Len())
+
+	x, err := v.Index(2)
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), x)
+
+	_, err = v.Index(4)
+	require.Error(t, err)
+
+	s, err := v.Slice(1, 3)
+	require.NoError(t, err)
+	require.NoError(t, s.Set(0, 20))
+
+	_, err = v.Slice(2, 5)
+	require.Error(t, err)
+
+	dst := make([]int32, 8)
+	n := v.Copy(dst)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []int32{1, 20, 3, 4}, dst[:n])
+	assert.Equal(t, []int32{20, 3}, CopyOut[int32](s.Pointer(), s.Len()))
+}
+
+func TestMemoryFree(t *testing.T) {
+	m, err := AllocManaged(16)
+	require.NoError(t, err)
+	assert.Len(t, m.Bytes(), 16)
+
+	m.Free()
+	m.Free()
+	assert.Nil(t, m.Pointer())
+	assert.Nil(t, m.Bytes())
+
+	// Typed nil is passed as NULL
+	var null *Memory
+	assert.Nil(t, null.Pointer())
+}
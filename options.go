@@ -0,0 +1,63 @@
+package dl
+
+import "reflect"
+
+// Option configures library opened with Open or function bound by Bind
+type Option func(*config)
+
+// config holds options of the library
+type config struct {
+	sanitize  bool
+	checkCode bool
+	expvar    string // name of expvar variable with statistics
+	labels    bool   // set pprof labels during calls
+	hooks     []Hook
+
+	conversion Conversion
+	converters map[reflect.Type]Converter // custom converters by Go type
+}
+
+func newConfig(options []Option) config {
+	var cfg config
+	for _, option := range options {
+		option(&cfg)
+	}
+	return cfg
+}
+
+// WithSanitizer enables sanitizer mode (linux only).
+// Every slice and pointer argument is copied into memory surrounded by
+// guard pages and canary bytes, so buffer overruns of the routine are
+// reported as *OverflowError instead of corrupting Go memory.
+// Sanitizer is intended for tests and slows down calls significantly.
+func WithSanitizer() Option {
+	return func(cfg *config) {
+		cfg.sanitize = true
+	}
+}
+
+// WithCodeCheck makes Bind validate, that the address lies in executable
+// mapping of a loaded object (linux only).
+func WithCodeCheck() Option {
+	return func(cfg *config) {
+		cfg.checkCode = true
+	}
+}
+
+// WithExpvar publishes call statistics (see Library.Stats) as expvar
+// variable with the name. Reopened library replaces the published one.
+func WithExpvar(name string) Option {
+	return func(cfg *config) {
+		cfg.expvar = name
+	}
+}
+
+// WithProfileLabels adds pprof label "dl_routine" with the name of the
+// routine to labels of the caller for the duration of each call (linux
+// only), so CPU profiles attribute samples to C functions. Labels of the
+// caller are taken from the context passed to CallContext.
+func WithProfileLabels() Option {
+	return func(cfg *config) {
+		cfg.labels = true
+	}
+}
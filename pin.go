@@ -0,0 +1,188 @@
+package dl
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// cgoCheck enables checking of Go pointers passed to C (see SetCgoCheck)
+var cgoCheck atomic.Bool
+
+func init() {
+	// DLDEBUG=cgocheck=1 enables checks for the whole process
+	for _, opt := range strings.Split(os.Getenv("DLDEBUG"), ",") {
+		if opt == "cgocheck=1" {
+			cgoCheck.Store(true)
+		}
+	}
+}
+
+// SetCgoCheck enables or disables debug mode, which rejects arguments
+// pointing to Go memory, that contains Go pointers itself
+// (similar to GODEBUG=cgocheck=1). It might be enabled by
+// environment variable DLDEBUG=cgocheck=1 too.
+func SetCgoCheck(enabled bool) {
+	cgoCheck.Store(enabled)
+}
+
+// retained argument stays pinned after the call
+type retained struct {
+	value interface{}
+}
+
+// Retain marks argument, which is kept by the library after the call returns
+// (for example, buffer registered for asynchronous use).
+// Memory of such argument stays pinned until the library is closed.
+func Retain(value interface{}) interface{} {
+	return retained{value: value}
+}
+
+// pinset is a set of Go objects pinned for the lifetime of the library
+type pinset struct {
+	sync.Mutex
+	pinner runtime.Pinner
+}
+
+func (ps *pinset) pin(v reflect.Value) {
+	ps.Lock()
+	defer ps.Unlock()
+
+	pinValue(&ps.pinner, v)
+}
+
+func (ps *pinset) unpin() {
+	ps.Lock()
+	defer ps.Unlock()
+
+	ps.pinner.Unpin()
+}
+
+// pinValue pins Go memory, which is referenced by the argument value.
+// Pointers stored in that memory (like pointer fields of structs) are
+// passed to C as well, so their targets are pinned too.
+func pinValue(pinner *runtime.Pinner, v reflect.Value) {
+	pinPointees(pinner, v, make(map[unsafe.Pointer]bool))
+}
+
+// pinPointees pins targets of pointers reachable from the value
+func pinPointees(pinner *runtime.Pinner, v reflect.Value, seen map[unsafe.Pointer]bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		p := v.UnsafePointer()
+		if p == nil || seen[p] {
+			return
+		}
+		seen[p] = true
+		pinner.Pin(p)
+		if hasPointers(v.Type().Elem()) {
+			pinPointees(pinner, v.Elem(), seen)
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return
+		}
+		p := v.UnsafePointer()
+		if !seen[p] {
+			seen[p] = true
+			pinner.Pin(p)
+		}
+		if hasPointers(v.Type().Elem()) {
+			for ii := 0; ii < v.Len(); ii++ {
+				pinPointees(pinner, v.Index(ii), seen)
+			}
+		}
+	case reflect.UnsafePointer:
+		if p := v.UnsafePointer(); p != nil {
+			// Pinning of non Go pointers is ignored by runtime
+			pinner.Pin(p)
+		}
+	case reflect.Array:
+		if hasPointers(v.Type().Elem()) {
+			for ii := 0; ii < v.Len(); ii++ {
+				pinPointees(pinner, v.Index(ii), seen)
+			}
+		}
+	case reflect.Struct:
+		for ii := 0; ii < v.NumField(); ii++ {
+			pinPointees(pinner, v.Field(ii), seen)
+		}
+	}
+}
+
+// checkGoPointers returns error, when memory referenced by argument contains Go pointers
+func checkGoPointers(v reflect.Value) error {
+	if !cgoCheck.Load() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || !hasPointers(v.Type().Elem()) {
+			return nil
+		}
+		if containsGoPointer(v.Elem()) {
+			return fmt.Errorf("cgocheck: argument of type %s points to memory containing Go pointer", v.Type())
+		}
+	case reflect.Slice:
+		if !hasPointers(v.Type().Elem()) {
+			return nil
+		}
+		for ii := 0; ii < v.Len(); ii++ {
+			if containsGoPointer(v.Index(ii)) {
+				return fmt.Errorf("cgocheck: argument of type %s contains Go pointer at index %d", v.Type(), ii)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hasPointers returns true, when values of type might contain Go pointers
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.String, reflect.Map,
+		reflect.Chan, reflect.Func, reflect.Interface:
+		return true
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case reflect.Struct:
+		for ii := 0; ii < t.NumField(); ii++ {
+			if hasPointers(t.Field(ii).Type) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsGoPointer returns true, when value holds non nil Go pointer.
+// Raw pointers (unsafe.Pointer and uintptr) are supposed to refer C memory.
+func containsGoPointer(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Chan, reflect.Func, reflect.Interface:
+		return !v.IsNil()
+	case reflect.String:
+		return v.Len() > 0
+	case reflect.Array:
+		for ii := 0; ii < v.Len(); ii++ {
+			if containsGoPointer(v.Index(ii)) {
+				return true
+			}
+		}
+	case reflect.Struct:
+		for ii := 0; ii < v.NumField(); ii++ {
+			if containsGoPointer(v.Field(ii)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,543 @@
+package dl
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// RecordVersion is the version of the record file format written by Record
+	RecordVersion = 1
+	recordFormat  = "dl-record"
+)
+
+// RecordHeader is the first line of the record file
+type RecordHeader struct {
+	Format  string    `json:"format"` // always "dl-record"
+	Version int       `json:"version"`
+	Library string    `json:"library,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// RecordedValue is a value of argument or result in JSON
+type RecordedValue struct {
+	Type string          `json:"type"`
+	In   json.RawMessage `json:"in,omitempty"`  // Value before the call (pointed value for pointers, slices and C memory)
+	Out  json.RawMessage `json:"out,omitempty"` // Pointed value after the call
+}
+
+// RecordedCall is a line of the record file, which follows the header
+type RecordedCall struct {
+	Seq      int             `json:"seq"`
+	Routine  string          `json:"routine"`
+	Args     []RecordedValue `json:"args,omitempty"`
+	Result   *RecordedValue  `json:"result,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Kind     *RecordedError  `json:"error_kind,omitempty"` // Typed error, if Error is one
+	Errno    int             `json:"errno,omitempty"`
+	Duration time.Duration   `json:"duration,omitempty"`
+}
+
+// RecordedError describes typed error of the call, so the replayed
+// error matches errors.Is and errors.As like the original one
+type RecordedError struct {
+	Kind string `json:"kind"` // library_not_found, incompatible_library, symbol_not_found, closed or argument
+	// Fields of *ArgumentError
+	Index  int    `json:"index,omitempty"`
+	Want   string `json:"want,omitempty"`
+	Got    string `json:"got,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// recordedKinds are checked in order, so the kind is stable,
+// when error matches several sentinels
+var recordedKinds = []struct {
+	kind string
+	err  error
+}{
+	{"library_not_found", ErrLibraryNotFound},
+	{"incompatible_library", ErrIncompatibleLibrary},
+	{"symbol_not_found", ErrSymbolNotFound},
+	{"closed", ErrClosed},
+}
+
+// recordError returns description of typed error, nil for other errors
+func recordError(err error) *RecordedError {
+	var argErr *ArgumentError
+	if errors.As(err, &argErr) {
+		res := &RecordedError{Kind: "argument", Index: argErr.Index, Want: argErr.Want, Got: argErr.Got}
+		if argErr.Err != nil {
+			res.Reason = argErr.Err.Error()
+		}
+		return res
+	}
+	for _, k := range recordedKinds {
+		if errors.Is(err, k.err) {
+			return &RecordedError{Kind: k.kind}
+		}
+	}
+	return nil
+}
+
+// replayedError is a recorded error, which wraps the rebuilt typed error
+type replayedError struct {
+	msg string
+	err error
+}
+
+func (e *replayedError) Error() string {
+	return e.msg
+}
+
+func (e *replayedError) Unwrap() error {
+	return e.err
+}
+
+// replayError rebuilds error of the recorded call
+func replayError(rec RecordedCall) error {
+	if rec.Kind == nil {
+		return errors.New(rec.Error)
+	}
+	if rec.Kind.Kind == "argument" {
+		argErr := &ArgumentError{
+			Routine: rec.Routine,
+			Index:   rec.Kind.Index,
+			Want:    rec.Kind.Want,
+			Got:     rec.Kind.Got,
+		}
+		if rec.Kind.Reason != "" {
+			argErr.Err = errors.New(rec.Kind.Reason)
+		}
+		return &replayedError{msg: rec.Error, err: argErr}
+	}
+	var sentinel error
+	for _, k := range recordedKinds {
+		if k.kind == rec.Kind.Kind {
+			sentinel = k.err
+		}
+	}
+	return &replayedError{msg: rec.Error, err: sentinel}
+}
+
+// errnoCaller is implemented by libraries, which capture errno of calls
+type errnoCaller interface {
+	callErrno(name string, arguments []interface{}) (interface{}, syscall.Errno, error)
+}
+
+// CallErrno calls routine like lib.Call does and returns errno set by it.
+// Errno is captured by native libraries, recorded by Record and returned
+// back by Replayer, other libraries report zero.
+func CallErrno(lib Library, name string, arguments ...interface{}) (interface{}, syscall.Errno, error) {
+	if c, ok := lib.(errnoCaller); ok {
+		return c.callErrno(name, arguments)
+	}
+	res, err := lib.Call(name, arguments...)
+	return res, 0, err
+}
+
+// recorder logs calls of the wrapped library
+type recorder struct {
+	Library
+	mu  sync.Mutex
+	enc *json.Encoder
+	seq int
+	err error // first write error
+}
+
+// Record returns library, which logs every Call of lib (arguments, buffers
+// passed by pointer before and after the call, result, error, errno and
+// duration) into w as JSON lines. Values, which can't be encoded as JSON
+// (like unsafe.Pointer), are recorded by type only.
+func Record(lib Library, w io.Writer) (Library, error) {
+	header := RecordHeader{
+		Format:  recordFormat,
+		Version: RecordVersion,
+		Created: time.Now().UTC(),
+	}
+	if info, err := lib.Info(); err == nil {
+		header.Library = info.Path
+	}
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(header); err != nil {
+		return nil, fmt.Errorf("record: %w", err)
+	}
+
+	return &recorder{Library: lib, enc: enc}, nil
+}
+
+func (r *recorder) Call(name string, arguments ...interface{}) (interface{}, error) {
+	res, _, err := r.callErrno(name, arguments)
+	return res, err
+}
+
+func (r *recorder) callErrno(name string, arguments []interface{}) (interface{}, syscall.Errno, error) {
+	rec := RecordedCall{
+		Routine: name,
+		Args:    make([]RecordedValue, len(arguments)),
+	}
+	for ii, argument := range arguments {
+		rec.Args[ii] = recordValue(argument)
+	}
+
+	start := time.Now()
+	res, errno, err := CallErrno(r.Library, name, arguments...)
+	rec.Duration = time.Since(start)
+
+	for ii, argument := range arguments {
+		if isReference(argument) {
+			rec.Args[ii].Out = encodeValue(referenced(argument))
+		}
+	}
+	if res != nil {
+		v := recordValue(res)
+		rec.Result = &v
+	}
+	if err != nil {
+		rec.Error = err.Error()
+		rec.Kind = recordError(err)
+	}
+	rec.Errno = int(errno)
+
+	r.mu.Lock()
+	r.seq++
+	rec.Seq = r.seq
+	if werr := r.enc.Encode(rec); werr != nil && r.err == nil {
+		r.err = werr
+	}
+	r.mu.Unlock()
+
+	return res, errno, err
+}
+
+// Close closes the library and reports the first error of writing the record
+func (r *recorder) Close() error {
+	err := r.Library.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && r.err != nil {
+		err = fmt.Errorf("record: %w", r.err)
+	}
+	return err
+}
+
+// recordValue describes argument before the call
+func recordValue(v interface{}) RecordedValue {
+	if r, ok := v.(retained); ok {
+		v = r.value
+	}
+
+	res := RecordedValue{Type: fmt.Sprintf("%T", v)}
+	if isReference(v) {
+		res.In = encodeValue(referenced(v))
+	} else if _, ok := v.(pointer); !ok {
+		res.In = encodeValue(v)
+	}
+	return res
+}
+
+// isReference returns true for values, which might be changed by the routine
+func isReference(v interface{}) bool {
+	if r, ok := v.(retained); ok {
+		v = r.value
+	}
+	if _, ok := v.(*Memory); ok {
+		return true
+	}
+
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Ptr && !rv.IsNil() || rv.Kind() == reflect.Slice
+}
+
+// referenced returns value pointed by reference
+func referenced(v interface{}) interface{} {
+	if r, ok := v.(retained); ok {
+		v = r.value
+	}
+	if m, ok := v.(*Memory); ok {
+		return m.Bytes()
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		return rv.Elem().Interface()
+	}
+	return v
+}
+
+func encodeValue(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// DivergenceError reports call, which differs from the recorded one
+type DivergenceError struct {
+	Seq  int
+	Want string // Recorded call
+	Got  string // Actual call
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("replay: call %d diverges from the record: want %s, got %s", e.Seq, e.Want, e.Got)
+}
+
+// Replayer is a library, which serves calls recorded by Record without
+// the native library. Routines must be defined as for the recorded one,
+// so results are decoded into the same types.
+type Replayer struct {
+	mu       sync.Mutex
+	header   RecordHeader
+	calls    []RecordedCall
+	next     int
+	routines map[string]*Routine
+	handles  HandleScope
+	chain    Chain
+	stats    Stats
+	closed   bool
+}
+
+var _ Library = (*Replayer)(nil)
+
+// Replay reads record written by Record
+func Replay(r io.Reader) (*Replayer, error) {
+	dec := json.NewDecoder(r)
+	rp := &Replayer{routines: make(map[string]*Routine)}
+	if err := dec.Decode(&rp.header); err != nil {
+		return nil, fmt.Errorf("replay: header: %w", err)
+	}
+	if rp.header.Format != recordFormat {
+		return nil, fmt.Errorf("replay: unknown format %q", rp.header.Format)
+	}
+	if rp.header.Version < 1 || rp.header.Version > RecordVersion {
+		return nil, fmt.Errorf("replay: unsupported version %d", rp.header.Version)
+	}
+
+	for {
+		var rec RecordedCall
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("replay: call %d: %w", len(rp.calls)+1, err)
+		}
+		rp.calls = append(rp.calls, rec)
+	}
+
+	return rp, nil
+}
+
+// Header returns header of the record
+func (rp *Replayer) Header() RecordHeader {
+	return rp.header
+}
+
+// Done returns error, when not all recorded calls were replayed
+func (rp *Replayer) Done() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rest := len(rp.calls) - rp.next; rest != 0 {
+		return fmt.Errorf("replay: %d recorded calls were not replayed", rest)
+	}
+	return nil
+}
+
+// Close releases handles, calls of closed Replayer report ErrClosed
+func (rp *Replayer) Close() error {
+	rp.mu.Lock()
+	rp.closed = true
+	rp.mu.Unlock()
+
+	rp.handles.Release()
+	return nil
+}
+
+func (rp *Replayer) Define(routine *Routine) error {
+	if routine == nil {
+		return errors.New("define: routine is nil")
+	}
+	if err := routine.Validate(); err != nil {
+		return fmt.Errorf("define %s: %w", routine.Name, err)
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.closed {
+		return fmt.Errorf("define %s: %w", routine.Name, ErrClosed)
+	}
+	rp.routines[routine.Name] = routine
+	return nil
+}
+
+func (rp *Replayer) Call(name string, arguments ...interface{}) (interface{}, error) {
+	res, _, err := rp.callErrno(name, arguments)
+	return res, err
+}
+
+// callErrno replays the call together with recorded errno
+func (rp *Replayer) callErrno(name string, arguments []interface{}) (interface{}, syscall.Errno, error) {
+	rp.mu.Lock()
+	routine, ok := rp.routines[name]
+	closed := rp.closed
+	rp.mu.Unlock()
+	if closed {
+		return nil, 0, fmt.Errorf("call: %w", ErrClosed)
+	}
+	if !ok {
+		return nil, 0, fmt.Errorf("call: find: %w: %s", ErrSymbolNotFound, name)
+	}
+
+	if len(arguments) != len(routine.Args) {
+		return nil, 0, fmt.Errorf("call: %w", argumentCount(routine, len(arguments)))
+	}
+
+	var errno syscall.Errno
+	ctx := CallInfo{Name: name, Routine: routine, Args: arguments}
+	res, err := rp.chain.Invoke(ctx, func(ctx CallInfo) (interface{}, error) {
+		start := time.Now()
+		res, err := rp.replay(routine, ctx.Args, &errno)
+		rp.stats.Observe(name, time.Since(start), err)
+		return res, err
+	})
+	return res, errno, err
+}
+
+// replay serves the next recorded call, errno of the call is stored into errno
+func (rp *Replayer) replay(routine *Routine, arguments []interface{}, errno *syscall.Errno) (interface{}, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	name := routine.Name
+
+	got := RecordedCall{Routine: name, Args: make([]RecordedValue, len(arguments))}
+	for ii, argument := range arguments {
+		got.Args[ii] = recordValue(argument)
+	}
+	if rp.next >= len(rp.calls) {
+		return nil, &DivergenceError{Seq: rp.next + 1, Want: "end of record", Got: describeCall(got)}
+	}
+	rec := rp.calls[rp.next]
+	if !sameCall(rec, got) {
+		return nil, &DivergenceError{Seq: rec.Seq, Want: describeCall(rec), Got: describeCall(got)}
+	}
+	rp.next++
+	*errno = syscall.Errno(rec.Errno)
+
+	// Reproduce changes of buffers
+	for ii, argument := range arguments {
+		if out := rec.Args[ii].Out; out != nil && isReference(argument) {
+			if err := restore(argument, out); err != nil {
+				return nil, fmt.Errorf("replay: call %d: argument %d: %w", rec.Seq, ii, err)
+			}
+		}
+	}
+
+	if rec.Error != "" {
+		return nil, replayError(rec)
+	}
+	if routine.Result == nil || rec.Result == nil {
+		return nil, nil
+	}
+
+	v := reflect.New(routine.Result.goType())
+	if rec.Result.In != nil {
+		if err := json.Unmarshal(rec.Result.In, v.Interface()); err != nil {
+			return nil, fmt.Errorf("replay: call %d: result: %w", rec.Seq, err)
+		}
+	}
+	return v.Elem().Interface(), nil
+}
+
+func (rp *Replayer) Symbol(name string, out interface{}) error {
+	return fmt.Errorf("symbol: %s: symbols are not recorded", name)
+}
+
+func (rp *Replayer) Verify() error {
+	return nil
+}
+
+func (rp *Replayer) Info() (*Info, error) {
+	return &Info{Path: rp.header.Library}, nil
+}
+
+func (rp *Replayer) NewHandle(v interface{}) Handle {
+	return rp.handles.NewHandle(v)
+}
+
+func (rp *Replayer) Use(interceptors ...Interceptor) {
+	rp.chain.Use(interceptors...)
+}
+
+func (rp *Replayer) Stats() map[string]RoutineStats {
+	return rp.stats.Snapshot()
+}
+
+func sameCall(a, b RecordedCall) bool {
+	if a.Routine != b.Routine || len(a.Args) != len(b.Args) {
+		return false
+	}
+	for ii := range a.Args {
+		if a.Args[ii].Type != b.Args[ii].Type || !sameJSON(a.Args[ii].In, b.Args[ii].In) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return bytes.Equal(a, b)
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+func describeCall(rec RecordedCall) string {
+	args := make([]string, len(rec.Args))
+	for ii, arg := range rec.Args {
+		args[ii] = arg.Type
+		if arg.In != nil {
+			args[ii] += " " + string(arg.In)
+		}
+	}
+	return fmt.Sprintf("%s(%s)", rec.Routine, strings.Join(args, ", "))
+}
+
+// restore writes recorded value into the reference
+func restore(v interface{}, data json.RawMessage) error {
+	if r, ok := v.(retained); ok {
+		v = r.value
+	}
+	if m, ok := v.(*Memory); ok {
+		var buf []byte
+		if err := json.Unmarshal(data, &buf); err != nil {
+			return err
+		}
+		copy(m.Bytes(), buf)
+		return nil
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Ptr {
+		return json.Unmarshal(data, v)
+	}
+
+	// Slice keeps its length, elements are overwritten
+	p := reflect.New(rv.Type())
+	if err := json.Unmarshal(data, p.Interface()); err != nil {
+		return err
+	}
+	reflect.Copy(rv, p.Elem())
+	return nil
+}
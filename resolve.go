@@ -0,0 +1,361 @@
+package dl
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Object describes ELF shared object
+type Object struct {
+	Path    string   `json:"path"`
+	Class   string   `json:"class"`   // ELFCLASS32 or ELFCLASS64
+	Machine string   `json:"machine"` // like EM_X86_64
+	SOName  string   `json:"soname,omitempty"`
+	Needed  []string `json:"needed,omitempty"`
+	RPath   []string `json:"rpath,omitempty"`
+	RunPath []string `json:"runpath,omitempty"`
+
+	class   elf.Class
+	machine elf.Machine
+}
+
+// ReadObject reads dynamic section and header of ELF object
+func ReadObject(path string) (*Object, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("read object: %w", err)
+	}
+	defer f.Close()
+
+	obj := &Object{
+		Path:    path,
+		Class:   f.Class.String(),
+		Machine: f.Machine.String(),
+		class:   f.Class,
+		machine: f.Machine,
+	}
+	if obj.Needed, err = f.DynString(elf.DT_NEEDED); err != nil {
+		return nil, fmt.Errorf("read object: %s: %w", path, err)
+	}
+	if names, _ := f.DynString(elf.DT_SONAME); len(names) != 0 {
+		obj.SOName = names[0]
+	}
+	obj.RPath = splitPath(f, elf.DT_RPATH)
+	obj.RunPath = splitPath(f, elf.DT_RUNPATH)
+
+	return obj, nil
+}
+
+func splitPath(f *elf.File, tag elf.DynTag) []string {
+	values, _ := f.DynString(tag)
+	var res []string
+	for _, v := range values {
+		for _, dir := range strings.Split(v, ":") {
+			if dir != "" {
+				res = append(res, dir)
+			}
+		}
+	}
+	return res
+}
+
+// Compatible returns error, when object can't be loaded into the current process
+func (obj *Object) Compatible() error {
+	class := elf.ELFCLASS64
+	if unsafe.Sizeof(uintptr(0)) == 4 {
+		class = elf.ELFCLASS32
+	}
+	if obj.class != class {
+		return fmt.Errorf("%s is %s object, but process is %d-bit", obj.Path, obj.Class, unsafe.Sizeof(uintptr(0))*8)
+	}
+	if machine, ok := machines[runtime.GOARCH]; ok && obj.machine != machine {
+		return fmt.Errorf("%s is built for %s, but process runs on %s", obj.Path, obj.Machine, machine)
+	}
+
+	return nil
+}
+
+// ELF machines of Go architectures
+var machines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// Dependency is a library needed by ELF object
+type Dependency struct {
+	Name     string   `json:"name"`   // DT_NEEDED entry
+	Parent   string   `json:"parent"` // Path of object, which needs the library
+	Object   *Object  `json:"object,omitempty"`
+	Searched []string `json:"searched,omitempty"` // Directories in search order
+	Error    string   `json:"error,omitempty"`
+}
+
+func (d Dependency) String() string {
+	name := d.Name
+	if d.Parent != "" {
+		name = fmt.Sprintf("%s (needed by %s)", d.Name, d.Parent)
+	}
+	switch {
+	case d.Error != "" && len(d.Searched) != 0:
+		return fmt.Sprintf("%s: %s, searched in %s", name, d.Error, strings.Join(d.Searched, ":"))
+	case d.Error != "":
+		return fmt.Sprintf("%s: %s", name, d.Error)
+	default:
+		return fmt.Sprintf("%s => %s", name, d.Object.Path)
+	}
+}
+
+// Resolve reads the library and finds all its dependencies (breadth-first,
+// like ldd does) the way the dynamic loader does: DT_RPATH of the object and
+// its parents, LD_LIBRARY_PATH, DT_RUNPATH, /etc/ld.so.conf and default
+// directories. Candidates of wrong ELF class or machine are skipped.
+// Unresolved dependencies have Error set.
+func Resolve(path string) (*Object, []Dependency, error) {
+	root, err := ReadObject(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve: %w", err)
+	}
+	if err := root.Compatible(); err != nil {
+		return root, nil, fmt.Errorf("resolve: %w", err)
+	}
+
+	type node struct {
+		obj    *Object
+		parent *node
+	}
+
+	var deps []Dependency
+	loaded := make(map[string]bool)
+	queue := []*node{{obj: root}}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, name := range n.obj.Needed {
+			if loaded[name] {
+				continue
+			}
+			loaded[name] = true
+
+			// Search order of the dynamic loader
+			var dirs []string
+			if len(n.obj.RunPath) == 0 {
+				for p := n; p != nil; p = p.parent {
+					dirs = append(dirs, expandOrigin(p.obj.RPath, p.obj.Path)...)
+				}
+			}
+			dirs = append(dirs, envDirs()...)
+			dirs = append(dirs, expandOrigin(n.obj.RunPath, n.obj.Path)...)
+			dirs = append(dirs, systemDirs()...)
+
+			dep := lookup(name, uniqueDirs(dirs))
+			dep.Parent = n.obj.Path
+			deps = append(deps, dep)
+			if dep.Object != nil {
+				queue = append(queue, &node{obj: dep.Object, parent: n})
+			}
+		}
+	}
+
+	return root, deps, nil
+}
+
+// lookup searches compatible library in directories
+func lookup(name string, dirs []string) Dependency {
+	dep := Dependency{Name: name}
+	if strings.ContainsRune(name, '/') {
+		dirs = []string{""}
+	} else {
+		dep.Searched = dirs
+	}
+
+	var rejected []string
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		obj, err := ReadObject(path)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s is not an ELF object", path))
+			continue
+		}
+		if err := obj.Compatible(); err != nil {
+			rejected = append(rejected, err.Error())
+			continue
+		}
+		dep.Object = obj
+		dep.Searched = nil
+		return dep
+	}
+
+	dep.Error = "not found"
+	if len(rejected) != 0 {
+		dep.Error = strings.Join(rejected, "; ")
+	}
+	return dep
+}
+
+// expandOrigin substitutes $ORIGIN in directories of RPATH and RUNPATH
+func expandOrigin(dirs []string, path string) []string {
+	origin := filepath.Dir(path)
+	if abs, err := filepath.Abs(origin); err == nil {
+		origin = abs
+	}
+
+	res := make([]string, len(dirs))
+	for ii, dir := range dirs {
+		dir = strings.ReplaceAll(dir, "${ORIGIN}", origin)
+		res[ii] = strings.ReplaceAll(dir, "$ORIGIN", origin)
+	}
+	return res
+}
+
+func envDirs() []string {
+	var res []string
+	for _, dir := range filepath.SplitList(os.Getenv("LD_LIBRARY_PATH")) {
+		if dir != "" {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+var (
+	sysDirsOnce sync.Once
+	sysDirs     []string
+)
+
+// systemDirs returns directories of /etc/ld.so.conf and default ones
+func systemDirs() []string {
+	sysDirsOnce.Do(func() {
+		sysDirs = uniqueDirs(append(readLdConf("/etc/ld.so.conf", 0), libraryDirs...))
+	})
+	return sysDirs
+}
+
+// readLdConf reads directories listed in ld.so.conf and included files
+func readLdConf(path string, depth int) []string {
+	f, err := os.Open(path)
+	if err != nil || depth > 8 {
+		return nil
+	}
+	defer f.Close()
+
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "include "):
+			pattern := strings.TrimSpace(line[len("include "):])
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			matches, _ := filepath.Glob(pattern)
+			for _, m := range matches {
+				res = append(res, readLdConf(m, depth+1)...)
+			}
+		default:
+			res = append(res, line)
+		}
+	}
+
+	return res
+}
+
+func uniqueDirs(dirs []string) []string {
+	seen := make(map[string]bool, len(dirs))
+	res := dirs[:0:0]
+	for _, dir := range dirs {
+		if !seen[dir] {
+			seen[dir] = true
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+// LoadError explains, why the dynamic loader failed to load the library
+type LoadError struct {
+	Library  string
+	Err      error        // Error reported by the dynamic loader
+	Problems []Dependency // Missing or incompatible libraries
+}
+
+func (e *LoadError) Error() string {
+	lines := []string{e.Err.Error()}
+	for _, p := range e.Problems {
+		lines = append(lines, p.String())
+	}
+	return strings.Join(lines, "\n\t")
+}
+
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// diagnose explains failure of dlopen by resolving dependencies of the library.
+// Kind of err is set to ErrLibraryNotFound, when the library or its dependency
+// is missing, and to ErrIncompatibleLibrary otherwise.
+// Original error is returned, when no problem is found.
+func diagnose(name string, err *loaderError) error {
+	err.kind = ErrIncompatibleLibrary
+	path := name
+	if !strings.ContainsRune(name, '/') {
+		dep := lookup(name, uniqueDirs(append(envDirs(), systemDirs()...)))
+		if dep.Object == nil {
+			if dep.Error == "not found" {
+				err.kind = ErrLibraryNotFound
+			}
+			return &LoadError{Library: name, Err: err, Problems: []Dependency{dep}}
+		}
+		path = dep.Object.Path
+	}
+
+	root, deps, rerr := Resolve(path)
+	if root == nil {
+		if _, serr := os.Stat(path); os.IsNotExist(serr) {
+			err.kind = ErrLibraryNotFound
+		}
+		return err
+	}
+	if rerr != nil {
+		return &LoadError{
+			Library:  name,
+			Err:      err,
+			Problems: []Dependency{{Name: name, Object: root, Error: strings.TrimPrefix(rerr.Error(), "resolve: ")}},
+		}
+	}
+
+	var problems []Dependency
+	for _, dep := range deps {
+		if dep.Error != "" {
+			problems = append(problems, dep)
+		}
+		if dep.Error == "not found" {
+			err.kind = ErrLibraryNotFound
+		}
+	}
+	if len(problems) == 0 {
+		return err
+	}
+
+	return &LoadError{Library: name, Err: err, Problems: problems}
+}
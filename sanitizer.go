@@ -0,0 +1,26 @@
+package dl
+
+import "fmt"
+
+// OverflowError is reported by sanitizer, when routine accesses
+// memory outside of the buffer passed as argument
+type OverflowError struct {
+	Routine string
+	Index   int  // Index of the argument
+	Offset  int  // Offset of the first damaged byte relative to the buffer start
+	Fault   bool // Access was trapped by guard page
+	// Address and symbolic name (like libc.so.6!memset+0x1c)
+	// of the faulting instruction, when access was trapped
+	PC       uintptr
+	Location string
+}
+
+func (e *OverflowError) Error() string {
+	if e.Fault && e.Location != "" {
+		return fmt.Sprintf("%s: argument %d: access to guard page at offset %d (at %s)", e.Routine, e.Index, e.Offset, e.Location)
+	}
+	if e.Fault {
+		return fmt.Sprintf("%s: argument %d: access to guard page at offset %d", e.Routine, e.Index, e.Offset)
+	}
+	return fmt.Sprintf("%s: argument %d: buffer overflow at offset %d", e.Routine, e.Index, e.Offset)
+}
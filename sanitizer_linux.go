@@ -0,0 +1,242 @@
+// +build linux
+
+package dl
+
+/*
+#define _GNU_SOURCE
+#include <pthread.h>
+#include <setjmp.h>
+#include <signal.h>
+#include <stdint.h>
+#include <string.h>
+#include <ucontext.h>
+
+extern int call(void *f, void **args, int *flags, int count, void **out);
+
+static struct sigaction guard_prev;
+static pthread_once_t guard_once = PTHREAD_ONCE_INIT;
+static __thread sigjmp_buf *guard_jmp;
+static __thread uintptr_t *guard_ranges;
+static __thread int guard_count;
+static __thread uintptr_t guard_addr;
+static __thread uintptr_t guard_pc;
+
+// Address of the faulting instruction
+static uintptr_t fault_pc(void *ctx)
+{
+#if defined(__x86_64__)
+    return (uintptr_t)((ucontext_t *)ctx)->uc_mcontext.gregs[REG_RIP];
+#elif defined(__aarch64__)
+    return (uintptr_t)((ucontext_t *)ctx)->uc_mcontext.pc;
+#else
+    return 0;
+#endif
+}
+
+// Handler catches faults on guard pages of the current guarded call
+// and passes all other signals to the previous (Go runtime) handler.
+static void guard_handler(int sig, siginfo_t *info, void *ctx)
+{
+    if (guard_jmp != NULL) {
+        uintptr_t addr = (uintptr_t)info->si_addr;
+        int ii;
+        for (ii = 0; ii < guard_count; ii++) {
+            if (addr >= guard_ranges[2*ii] && addr < guard_ranges[2*ii+1]) {
+                guard_addr = addr;
+                guard_pc = fault_pc(ctx);
+                siglongjmp(*guard_jmp, 1);
+            }
+        }
+    }
+    if (guard_prev.sa_flags & SA_SIGINFO) {
+        guard_prev.sa_sigaction(sig, info, ctx);
+    } else if (guard_prev.sa_handler != SIG_DFL && guard_prev.sa_handler != SIG_IGN) {
+        guard_prev.sa_handler(sig);
+    }
+}
+
+static void guard_install(void)
+{
+    struct sigaction sa;
+    memset(&sa, 0, sizeof(sa));
+    sa.sa_sigaction = guard_handler;
+    sa.sa_flags = SA_SIGINFO | SA_ONSTACK | SA_RESTART;
+    sigemptyset(&sa.sa_mask);
+    sigaction(SIGSEGV, &sa, &guard_prev);
+}
+
+// Same as call, but returns 2, the fault address and the faulting instruction,
+// when the routine touches one of the guard ranges (pairs of [lo, hi)).
+static int guarded_call(void *f, void **args, int *flags, int count, void **out, uintptr_t *ranges, int range_count, uintptr_t *fault, uintptr_t *pc)
+{
+    sigjmp_buf jmp;
+    pthread_once(&guard_once, guard_install);
+    if (sigsetjmp(jmp, 1) != 0) {
+        guard_jmp = NULL;
+        guard_count = 0;
+        *fault = guard_addr;
+        *pc = guard_pc;
+        return 2;
+    }
+    guard_ranges = ranges;
+    guard_count = range_count;
+    guard_jmp = &jmp;
+    int res = call(f, args, flags, count, out);
+    guard_jmp = NULL;
+    guard_count = 0;
+    return res;
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// Alignment of buffer copies inside guarded regions
+	guardAlign = 16
+	// Filler of the unused bytes between buffer copy and guard pages
+	guardCanary = 0xA5
+)
+
+// guarded is a copy of the buffer argument surrounded by guard pages:
+// [guard page][canary][buffer][canary][guard page].
+// Buffer is aligned to the end of the region, so overruns hit the guard page quickly.
+type guarded struct {
+	index  int
+	region []byte
+	offset int
+	buffer []byte
+}
+
+// sanitizer holds guarded copies of the arguments of a single call
+type sanitizer struct {
+	routine string
+	buffers []*guarded
+	errno   syscall.Errno // errno set by the routine
+}
+
+// protect copies buffer into guarded region and returns address of the copy
+func (san *sanitizer) protect(index int, buffer []byte) (unsafe.Pointer, error) {
+	page := syscall.Getpagesize()
+	size := (len(buffer) + guardAlign - 1) &^ (guardAlign - 1)
+	pages := (size + page - 1) / page
+	region, err := syscall.Mmap(-1, 0, (pages+2)*page, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("sanitizer: %w", err)
+	}
+	err = syscall.Mprotect(region[:page], syscall.PROT_NONE)
+	if err == nil {
+		err = syscall.Mprotect(region[len(region)-page:], syscall.PROT_NONE)
+	}
+	if err != nil {
+		_ = syscall.Munmap(region)
+		return nil, fmt.Errorf("sanitizer: %w", err)
+	}
+
+	g := &guarded{
+		index:  index,
+		region: region,
+		offset: len(region) - page - size,
+		buffer: buffer,
+	}
+	body := region[page : len(region)-page]
+	for ii := range body {
+		body[ii] = guardCanary
+	}
+	copy(region[g.offset:], buffer)
+	san.buffers = append(san.buffers, g)
+
+	return unsafe.Pointer(&region[g.offset]), nil
+}
+
+// call invokes routine with guard pages being trapped
+func (san *sanitizer) call(handle unsafe.Pointer, argp *unsafe.Pointer, flags *C.int, count int, out *unsafe.Pointer) error {
+	ranges := make([]C.uintptr_t, 0, 4*len(san.buffers))
+	page := syscall.Getpagesize()
+	for _, g := range san.buffers {
+		lo := uintptr(unsafe.Pointer(&g.region[0]))
+		hi := lo + uintptr(len(g.region))
+		ranges = append(ranges,
+			C.uintptr_t(lo), C.uintptr_t(lo+uintptr(page)),
+			C.uintptr_t(hi-uintptr(page)), C.uintptr_t(hi),
+		)
+	}
+
+	var rangep *C.uintptr_t
+	if len(ranges) > 0 {
+		rangep = &ranges[0]
+	}
+	var fault, pc C.uintptr_t
+	res, cerr := C.guarded_call(handle, argp, flags, C.int(count), out, rangep, C.int(len(ranges)/2), &fault, &pc)
+	san.errno, _ = cerr.(syscall.Errno)
+	switch res {
+	case 0:
+		return nil
+	case 2:
+		return san.fault(uintptr(fault), uintptr(pc))
+	default:
+		return errCall(*out)
+	}
+}
+
+// fault returns error for access to the guard page at address addr
+// by instruction at address pc
+func (san *sanitizer) fault(addr, pc uintptr) error {
+	for _, g := range san.buffers {
+		lo := uintptr(unsafe.Pointer(&g.region[0]))
+		if addr >= lo && addr < lo+uintptr(len(g.region)) {
+			return &OverflowError{
+				Routine:  san.routine,
+				Index:    g.index,
+				Offset:   int(addr-lo) - g.offset,
+				Fault:    true,
+				PC:       pc,
+				Location: symbolize(pc),
+			}
+		}
+	}
+
+	if loc := symbolize(pc); loc != "" {
+		return fmt.Errorf("%s: access to guard page at %#x (at %s)", san.routine, addr, loc)
+	}
+	return fmt.Errorf("%s: access to guard page at %#x", san.routine, addr)
+}
+
+// restore copies buffers back, checks canaries and releases regions
+func (san *sanitizer) restore() error {
+	var err error
+	page := syscall.Getpagesize()
+	for _, g := range san.buffers {
+		if err == nil {
+			copy(g.buffer, g.region[g.offset:])
+			err = g.check(san.routine, page)
+		}
+		_ = syscall.Munmap(g.region)
+	}
+	san.buffers = nil
+
+	return err
+}
+
+// check returns error, when canary bytes are damaged
+func (g *guarded) check(routine string, page int) error {
+	end := g.offset + len(g.buffer)
+	for ii := page; ii < len(g.region)-page; ii++ {
+		if ii >= g.offset && ii < end {
+			continue
+		}
+		if g.region[ii] != guardCanary {
+			return &OverflowError{
+				Routine: routine,
+				Index:   g.index,
+				Offset:  ii - g.offset,
+			}
+		}
+	}
+
+	return nil
+}
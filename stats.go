@@ -0,0 +1,179 @@
+package dl
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// LatencyBuckets are upper bounds of latency histogram buckets
+var LatencyBuckets = []time.Duration{
+	time.Microsecond,
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+}
+
+// RoutineStats are counters of calls of a routine
+type RoutineStats struct {
+	Calls  uint64        `json:"calls"`
+	Errors uint64        `json:"errors"`
+	Total  time.Duration `json:"total"` // Total latency
+	Max    time.Duration `json:"max"`   // Maximal latency
+	// Count of calls by latency: Histogram[i] counts calls not longer
+	// than LatencyBuckets[i], the last element counts the rest
+	Histogram []uint64 `json:"histogram"`
+}
+
+// Mean returns average latency of calls
+func (rs RoutineStats) Mean() time.Duration {
+	if rs.Calls == 0 {
+		return 0
+	}
+	return rs.Total / time.Duration(rs.Calls)
+}
+
+// Stats collects call statistics per routine, it is safe for concurrent use.
+// It helps other implementations of Library to support Stats.
+type Stats struct {
+	mu       sync.Mutex
+	routines map[string]*RoutineStats
+}
+
+// Observe counts call of the routine
+func (s *Stats) Observe(name string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.routines == nil {
+		s.routines = make(map[string]*RoutineStats)
+	}
+	rs, ok := s.routines[name]
+	if !ok {
+		rs = &RoutineStats{Histogram: make([]uint64, len(LatencyBuckets)+1)}
+		s.routines[name] = rs
+	}
+
+	rs.Calls++
+	if err != nil {
+		rs.Errors++
+	}
+	rs.Total += latency
+	if latency > rs.Max {
+		rs.Max = latency
+	}
+	bucket := len(LatencyBuckets)
+	for ii, bound := range LatencyBuckets {
+		if latency <= bound {
+			bucket = ii
+			break
+		}
+	}
+	rs.Histogram[bucket]++
+}
+
+// Snapshot returns copy of the counters by routine name
+func (s *Stats) Snapshot() map[string]RoutineStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]RoutineStats, len(s.routines))
+	for name, rs := range s.routines {
+		cp := *rs
+		cp.Histogram = append([]uint64(nil), rs.Histogram...)
+		res[name] = cp
+	}
+	return res
+}
+
+// Publish exports the counters as expvar variable with the name. Publishing
+// another Stats with the same name replaces the previous one (for example,
+// when the library is reopened). Name must not be used by other variables.
+func (s *Stats) Publish(name string) {
+	publishedMu.Lock()
+	defer publishedMu.Unlock()
+
+	v, ok := published[name]
+	if !ok {
+		v = &statsVar{}
+		published[name] = v
+		expvar.Publish(name, v)
+	}
+	v.set(s)
+}
+
+var (
+	publishedMu sync.Mutex
+	published   = make(map[string]*statsVar)
+)
+
+// statsVar is expvar variable with the current Stats
+type statsVar struct {
+	mu    sync.Mutex
+	stats *Stats
+}
+
+func (v *statsVar) set(s *Stats) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.stats = s
+}
+
+func (v *statsVar) String() string {
+	v.mu.Lock()
+	s := v.stats
+	v.mu.Unlock()
+
+	data, err := json.Marshal(s.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(data)
+}
+
+// measure calls the routine and counts it
+func (sc *scope) measure(name string, call func() (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	res, err := call()
+	sc.stats.Observe(name, time.Since(start), err)
+	return res, err
+}
+
+// profile runs the call with pprof label "dl_routine" added to labels
+// of ctx, when profile labels are enabled. Labels of ctx are set back
+// after the call (see pprof.Do).
+func (sc *scope) profile(ctx context.Context, name string, call func(ctx context.Context) (interface{}, error)) (res interface{}, err error) {
+	if !sc.config.labels {
+		return call(ctx)
+	}
+	pprof.Do(ctx, pprof.Labels("dl_routine", name), func(ctx context.Context) {
+		res, err = call(ctx)
+	})
+	return res, err
+}
+
+// contextCaller is implemented by libraries, which pass context of the call to interceptors
+type contextCaller interface {
+	callContext(ctx context.Context, name string, arguments []interface{}) (interface{}, error)
+}
+
+// CallContext calls the routine of the library with pprof label "dl_routine"
+// added to labels of ctx, so CPU profiles attribute samples to C functions.
+// Labels of ctx are set back after the call (see pprof.Do). Interceptors
+// receive the labeled context as CallInfo.Context.
+func CallContext(ctx context.Context, lib Library, name string, arguments ...interface{}) (res interface{}, err error) {
+	pprof.Do(ctx, pprof.Labels("dl_routine", name), func(ctx context.Context) {
+		if c, ok := lib.(contextCaller); ok {
+			res, err = c.callContext(ctx, name, arguments)
+		} else {
+			res, err = lib.Call(name, arguments...)
+		}
+	})
+	return res, err
+}